@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/kitwalker12/fotomat/metrics"
+)
+
+var (
+	adminListenAddr = flag.String("admin_listen", "", "[IP]:port to serve /healthz, /readyz, /metrics, and /debug/pprof/ on (\"\"=disable).")
+	readyMaxBusy    = flag.Float64("ready_max_busy", 0.9, "Fraction of fetch slots in use above which /readyz fails (0=disable).")
+	readyTimeout    = flag.Duration("ready_timeout", time.Second, "How long /readyz waits for a self-test resize.")
+
+	// adminMux serves operational endpoints, kept off the public listener.
+	adminMux = http.NewServeMux()
+
+	adminListener net.Listener
+	adminClosed   int32
+)
+
+func adminInit() {
+	// Copy flags, which reload may modify concurrently.
+	timeout, maxBusy := *readyTimeout, *readyMaxBusy
+
+	adminMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	adminMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := imageProxy.Ready(timeout, maxBusy); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+	adminMux.Handle("/metrics", metrics.Default)
+
+	// Importing net/http/pprof also registers these on
+	// http.DefaultServeMux, which is why listen uses publicMux instead.
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// serveAdmin starts serving adminMux on admin_listen, if set.  Call it
+// after postRun, so that imageProxy exists.
+func serveAdmin() {
+	if *adminListenAddr == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", *adminListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	adminListener = listener
+
+	go func() {
+		err := http.Serve(listener, adminMux)
+		if atomic.LoadInt32(&adminClosed) == 0 {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// closeAdmin stops accepting admin connections.  Call it before
+// imageProxy.Close; requests on open connections still get answers, with
+// /readyz failing.
+func closeAdmin() {
+	if adminListener == nil {
+		return
+	}
+
+	atomic.StoreInt32(&adminClosed, 1)
+	adminListener.Close()
+}
+
+func init() {
+	post(adminInit)
+}
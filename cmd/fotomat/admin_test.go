@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminMux(t *testing.T) {
+	for _, path := range []string{"/healthz", "/readyz", "/metrics", "/debug/pprof/", "/debug/pprof/cmdline"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, nil)
+		adminMux.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+
+	// Admin endpoints aren't served on the public listener.
+	assert.NotEqual(t, http.StatusOK, status("debug/pprof/"))
+	assert.NotEqual(t, http.StatusOK, status("metrics"))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+var (
+	configFile = flag.String("config", "", "Read settings from this JSON file, which command-line flags override (\"\"=disable).")
+
+	// presetConfigs are the "presets" from the config file.
+	presetConfigs map[string]preset
+	// routeConfigs are the "routes" from the config file.
+	routeConfigs []route
+)
+
+// loadConfig applies the settings in a JSON config file to every flag that
+// wasn't given on the command line.  Keys are flag names, eg.
+// {"max_output_dimension": 1024}, plus "presets" and "routes" in the same
+// form as presets_file and routes_file.  Unknown keys and bad values are
+// errors.
+func loadConfig(filename string) error {
+	presetConfigs, routeConfigs = nil, nil
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	d := json.NewDecoder(f)
+	d.UseNumber()
+	err = d.Decode(&raw)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	// Flags given on the command line take precedence.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for key, v := range raw {
+		if key == "presets" {
+			o, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: presets: must be an object", filename)
+			}
+			presetConfigs = map[string]preset{}
+			for name, po := range o {
+				var p preset
+				if err := decodeObject(po, &p); err != nil {
+					return fmt.Errorf("%s: presets.%s: %s", filename, name, err)
+				}
+				presetConfigs[name] = p
+			}
+			continue
+		}
+		if key == "routes" {
+			a, ok := v.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s: routes: must be an array of objects", filename)
+			}
+			for _, ro := range a {
+				var r route
+				if err := decodeObject(ro, &r); err != nil {
+					return fmt.Errorf("%s: routes: %s", filename, err)
+				}
+				routeConfigs = append(routeConfigs, r)
+			}
+			continue
+		}
+
+		f := flag.Lookup(key)
+		if f == nil || key == "config" {
+			return fmt.Errorf("%s: unknown setting %q", filename, key)
+		}
+
+		switch v.(type) {
+		case string, bool, json.Number:
+		default:
+			return fmt.Errorf("%s: %s: must be a string, number, or boolean", filename, key)
+		}
+
+		// Check the value even if the command line overrides it.
+		old := f.Value.String()
+		if err := f.Value.Set(fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("%s: %s: %s", filename, key, err)
+		}
+		if set[key] {
+			f.Value.Set(old)
+		}
+	}
+
+	return nil
+}
+
+// decodeObject decodes a parsed JSON object into the struct pointed to by
+// v, as json.Unmarshal would, except that keys that don't match a field
+// are errors.
+func decodeObject(object interface{}, v interface{}) error {
+	o, ok := object.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("must be an object")
+	}
+
+	fields := map[string]bool{}
+	structFields(reflect.TypeOf(v).Elem(), fields)
+	for k := range o {
+		if !fields[strings.ToLower(k)] {
+			return fmt.Errorf("unknown setting %q", k)
+		}
+	}
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// structFields adds the lowercased names of t's exported fields, including
+// those of embedded structs, to fields.
+func structFields(t reflect.Type, fields map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch {
+		case f.Anonymous && f.Type.Kind() == reflect.Struct:
+			structFields(f.Type, fields)
+		case f.PkgPath == "":
+			fields[strings.ToLower(f.Name)] = true
+		}
+	}
+}
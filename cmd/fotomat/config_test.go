@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defer func(dimension int, timeout time.Duration, bytes int64) {
+		*maxOutputDimension, *fetchTimeout, *diskCacheBytes = dimension, timeout, bytes
+		presetConfigs, routeConfigs = nil, nil
+	}(*maxOutputDimension, *fetchTimeout, *diskCacheBytes)
+
+	// Flags given on the command line win over the config file.
+	defer flag.Set("max_queue_duration", (*maxQueueDuration).String())
+	flag.Set("max_queue_duration", "1s")
+
+	filename := writeConfig(`{
+	"max_output_dimension": 1024,
+	"fetch_timeout": "5s",
+	"disk_cache_bytes": 1073741824,
+	"max_queue_duration": "1m",
+	"presets": {
+		"avatar": {"operation": "c96x96-attention", "sharpen": true}
+	},
+	"routes": [
+		{"host": "img.example.com", "upstream": "https://origin.example.com/", "quality": 80}
+	]
+}`)
+	defer os.Remove(filename)
+
+	assert.Nil(t, loadConfig(filename))
+	assert.Equal(t, 1024, *maxOutputDimension)
+	assert.Equal(t, 5*time.Second, *fetchTimeout)
+	assert.Equal(t, int64(1073741824), *diskCacheBytes)
+	assert.Equal(t, time.Second, *maxQueueDuration)
+	assert.Equal(t, "c96x96-attention", presetConfigs["avatar"].Operation)
+	assert.True(t, *presetConfigs["avatar"].Sharpen)
+	assert.Equal(t, "img.example.com", routeConfigs[0].Host)
+	assert.Equal(t, 80, routeConfigs[0].Quality)
+
+	// Presets from the config file can be used like those from presets_file.
+	presets, err := loadPresets(currentConfig(), "", presetConfigs)
+	assert.Nil(t, err)
+	assert.Equal(t, 96, presets["avatar"].Width)
+
+	assert.Nil(t, loadConfig(""))
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	defer func(dimension int) {
+		*maxOutputDimension = dimension
+		presetConfigs, routeConfigs = nil, nil
+	}(*maxOutputDimension)
+
+	for _, bad := range []string{
+		`{"no_such_flag": 1}`,
+		`{"config": "other.json"}`,
+		`{"max_output_dimension": "big"}`,
+		`{"max_output_dimension": 1.5}`,
+		`{"max_output_dimension": [1, 2]}`,
+		`{"max_output_dimension": null}`,
+		`{"fetch_timeout": "soon"}`,
+		`{"presets": {"avatar": {"operaton": "c96x96"}}}`,
+		`{"presets": ["avatar"]}`,
+		`{"routes": [{"upstrem": "http://origin.example.com"}]}`,
+		`{"routes": {"host": "img.example.com"}}`,
+		`{"max_output_dimension":}`,
+		`max_output_dimension = 1024`,
+	} {
+		filename := writeConfig(bad)
+		assert.NotNil(t, loadConfig(filename), bad)
+		os.Remove(filename)
+	}
+
+	assert.NotNil(t, loadConfig("/nonexistent/fotomat.json"))
+}
+
+func TestDecodeObject(t *testing.T) {
+	var r route
+	assert.Nil(t, decodeObject(map[string]interface{}{"host": "img.example.com", "Quality": 80, "sharpen": true}, &r))
+	assert.Equal(t, "img.example.com", r.Host)
+	assert.Equal(t, 80, r.Quality)
+	assert.True(t, *r.Sharpen)
+
+	assert.NotNil(t, decodeObject(map[string]interface{}{"upstrem": "x"}, &r))
+	assert.NotNil(t, decodeObject(map[string]interface{}{"quality": "high"}, &r))
+	assert.NotNil(t, decodeObject("not an object", &r))
+}
+
+func writeConfig(config string) string {
+	f, err := ioutil.TempFile("", "fotomat-config")
+	if err != nil {
+		panic(err)
+	}
+	f.WriteString(config)
+	f.Close()
+	return f.Name()
+}
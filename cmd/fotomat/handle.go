@@ -1,95 +1,324 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/kitwalker12/fotomat/format"
 	"github.com/kitwalker12/fotomat/thumbnail"
+	"github.com/kitwalker12/fotomat/trace"
 )
 
 var (
+	accessLog             = flag.String("access_log", "", "Append JSON access logs to this file, or \"-\" for stdout (\"\"=disable).")
+	accessLogSample       = flag.Float64("access_log_sample", 1.0, "Fraction of successful requests to log; failures are always logged.")
+	diskCacheBytes        = flag.Int64("disk_cache_bytes", 10<<30, "Maximum bytes of generated images to cache in disk_cache_directory.")
+	diskCacheDirectory    = flag.String("disk_cache_directory", "", "Cache generated images in this directory across restarts (\"\"=disable).")
 	fastResize            = flag.Bool("fast_resize", false, "Allow faster resizing, at lower image quality in some cases.")
 	fetchTimeout          = flag.Duration("fetch_timeout", 30*time.Second, "How long to wait to receive original image from source (0=disable).")
 	localImageDirectory   = flag.String("local_image_directory", "", "Enable local image serving from this path (\"\"=proxy instead).")
 	lossless              = flag.Bool("lossless", true, "Allow saving as PNG even without transparency.")
 	lossyIfPhoto          = flag.Bool("lossy_if_photo", true, "Save as lossy if image is detected as a photo.")
-	losslessWebp          = flag.Bool("lossless_webp", false, "When saving in WebP, allow lossless encoding.")
+	losslessWebp          = flag.Bool("lossless_webp", false, "When saving in WebP or AVIF, allow lossless encoding.")
 	maxBufferPixels       = flag.Int("max_buffer_pixels", 6500000, "Maximum number of pixels to allocate for an intermediate image buffer.")
+	maxFrames             = flag.Int("max_frames", 250, "Maximum number of frames in an animated image (0=unlimited).")
 	maxImageThreads       = flag.Int("max_image_threads", numCPUCores(), "Maximum number of threads simultaneously processing images (0=all CPUs).")
+	maxOriginalBytes      = flag.Int64("max_original_bytes", 100<<20, "Maximum bytes of an original image to download (0=unlimited).")
 	maxOutputDimension    = flag.Int("max_output_dimension", 2048, "Maximum width or height of an image response.")
 	maxPrefetch           = flag.Int("max_prefetch", numCPUCores(), "Maximum number of images to prefetch before thread is available.")
 	maxProcessingDuration = flag.Duration("max_processing_duration", time.Minute, "Maximum duration we can be processing an image before assuming we crashed (0=disable).")
 	maxQueueDuration      = flag.Duration("max_queue_duration", 10*time.Second, "Maximum delay of pre-image-fetch queue before returning error (0=disable).")
+	maxTotalPixels        = flag.Int("max_total_pixels", 50000000, "Maximum number of pixels in all frames of an animated image combined (0=unlimited).")
+	memoryCacheBytes      = flag.Int64("memory_cache_bytes", 0, "Maximum bytes of generated images to cache in RAM (0=disable).")
+	negotiateFormat       = flag.Bool("negotiate_format", false, "Choose WebP or AVIF output from the Accept header instead of the \"w\" flag.")
+	originalCacheBytes    = flag.Int64("original_cache_bytes", 0, "Maximum bytes of original images to cache in RAM for reuse at other sizes (0=disable).")
+	presetsFile           = flag.String("presets_file", "", "Load named presets, requested as \"=preset:name\", from this JSON file (\"\"=disable).")
+	presetsOnly           = flag.Bool("presets_only", false, "Refuse requests that don't use a preset.")
+	routesFile            = flag.String("routes_file", "", "Only fetch originals from upstreams listed in this JSON routing table (\"\"=use Host header).")
 	sharpen               = flag.Bool("sharpen", false, "Sharpen after resize.")
+	traceExporter         = flag.String("trace_exporter", "", "Send trace spans to \"stdout\" or to this OTLP/HTTP collector URL, eg. http://127.0.0.1:4318/v1/traces (\"\"=disable).")
+	traceSample           = flag.Float64("trace_sample", 0.01, "Fraction of new traces to record; incoming traceparent headers decide for themselves.")
+	upstreamAllowlist     = flag.String("upstream_allowlist", "", "Comma-separated IPs or CIDRs that upstreams may resolve to even if loopback, private, link-local, or metadata service addresses.")
+	urlSigningKeyFile     = flag.String("url_signing_key_file", "", "Require signed URLs, verified with keys read from this file, one per line (\"\"=disable).")
+	urlSigningKeys        = flag.String("url_signing_keys", "", "Require signed URLs, verified with any of these comma-separated keys (\"\"=disable).")
 
-	matchPath = regexp.MustCompile(`^(/.*)=(p?)(w?)([sc])(\d{1,5})x(\d{1,5})$`)
+	// config holds the current *directorConfig.
+	config atomic.Value
+
+	imageProxy *thumbnail.Proxy
+
+	// otlpExporter, if set, must be closed to send its last spans.
+	otlpExporter *trace.OTLPExporter
+
+	// publicMux serves images on listen.  Admin endpoints are on adminMux.
+	publicMux = http.NewServeMux()
+
+	matchPath      = regexp.MustCompile(`^(/.*)=([^=/]+)$`)
+	matchOperation = regexp.MustCompile(`^(p?)(w?)([scb])(\d{1,5})x(\d{1,5})((?:-[a-z0-9.,]+)*)$`)
+	matchPreset    = regexp.MustCompile(`^preset:([a-z0-9_]+)$`)
+	matchFocus     = regexp.MustCompile(`^f(\d*\.?\d+),(\d*\.?\d+)$`)
+	matchEnlarge   = regexp.MustCompile(`^up(\d*\.?\d+)?$`)
+	matchColor     = regexp.MustCompile(`^bg([0-9a-f]{2})([0-9a-f]{2})([0-9a-f]{2})([0-9a-f]{2})?$`)
+
+	// gravities are the crop and pad placements a request can name.
+	// "entropy" and "attention" crop animations from the center.
+	gravities = map[string]thumbnail.Gravity{
+		"center":    thumbnail.GravityCenter,
+		"north":     thumbnail.GravityNorth,
+		"south":     thumbnail.GravitySouth,
+		"east":      thumbnail.GravityEast,
+		"west":      thumbnail.GravityWest,
+		"entropy":   thumbnail.GravityEntropy,
+		"attention": thumbnail.GravityAttention,
+	}
 )
 
+// directorConfig holds the settings used by director, which can be
+// replaced while running by reload.
+type directorConfig struct {
+	maxOutputDimension int
+	losslessWebp       bool
+	// defaults are the Options every operation starts from.
+	defaults    thumbnail.Options
+	presets     map[string]thumbnail.Options
+	presetsOnly bool
+	signingKeys [][]byte
+	// routes, if not empty, are the only places originals are fetched.
+	routes []*upstream
+}
+
+// newDirectorConfig builds a directorConfig from the current flags,
+// reading any files they name.
+func newDirectorConfig() (*directorConfig, error) {
+	c := &directorConfig{
+		maxOutputDimension: *maxOutputDimension,
+		losslessWebp:       *losslessWebp,
+		defaults: thumbnail.Options{
+			MaxBufferPixels:       *maxBufferPixels,
+			MaxFrames:             *maxFrames,
+			MaxTotalPixels:        *maxTotalPixels,
+			Sharpen:               *sharpen,
+			FastResize:            *fastResize,
+			MaxQueueDuration:      *maxQueueDuration,
+			MaxProcessingDuration: *maxProcessingDuration,
+			Save: format.SaveOptions{
+				Lossless:     *lossless,
+				LossyIfPhoto: *lossyIfPhoto,
+				// Applies to WebP and AVIF chosen by negotiation.
+				LossyWebp: !*losslessWebp,
+			},
+		},
+		presetsOnly: *presetsOnly,
+	}
+
+	var err error
+	if c.signingKeys, err = loadSigningKeys(*urlSigningKeys, *urlSigningKeyFile); err != nil {
+		return nil, err
+	}
+	if c.presets, err = loadPresets(c, *presetsFile, presetConfigs); err != nil {
+		return nil, err
+	}
+	if c.routes, err = loadRoutes(c, *routesFile, routeConfigs); err != nil {
+		return nil, err
+	}
+	if *localImageDirectory != "" {
+		if len(c.routes) > 0 {
+			return nil, errors.New("local_image_directory can't be used with routes")
+		}
+		local, err := localRoute(c, *localImageDirectory)
+		if err != nil {
+			return nil, err
+		}
+		c.routes = []*upstream{local}
+	}
+
+	return c, nil
+}
+
+func currentConfig() *directorConfig {
+	return config.Load().(*directorConfig)
+}
+
 func handleInit() {
+	c, err := newDirectorConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Store(c)
+
 	pool := thumbnail.NewPool(*maxImageThreads, 1)
 
-	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
-	if *localImageDirectory != "" {
-		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(*localImageDirectory)))
+	allow, err := parseAllowlist(*upstreamAllowlist)
+	if err != nil {
+		log.Fatal(err)
 	}
+	guard := thumbnail.NewAddressGuard(allow, *fetchTimeout)
+
+	// HTTP_PROXY isn't used, as guard would only check the proxy's
+	// address.  Local files are only served from routes' directories.
+	transport := guardedTransport(guard)
+	transport.RegisterProtocol("file", http.NewFileTransport(routeFiles{}))
 
-	client := &http.Client{Transport: http.RoundTripper(transport), Timeout: *fetchTimeout}
+	client := &http.Client{Transport: http.RoundTripper(transport), Timeout: *fetchTimeout, CheckRedirect: checkRedirect}
+
+	imageProxy = thumbnail.NewProxy(director, pool, *maxPrefetch+*maxImageThreads, client)
+	imageProxy.NegotiateFormat = *negotiateFormat
+	imageProxy.MaxOriginalBytes = *maxOriginalBytes
+	var caches thumbnail.TieredCache
+	if *memoryCacheBytes > 0 {
+		caches = append(caches, thumbnail.NewMemoryCache(*memoryCacheBytes))
+	}
+	if *diskCacheDirectory != "" {
+		disk, err := thumbnail.NewDiskCache(*diskCacheDirectory, *diskCacheBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		caches = append(caches, disk)
+	}
+	if len(caches) > 0 {
+		imageProxy.Cache = caches
+	}
+	if *originalCacheBytes > 0 {
+		imageProxy.OriginalCache = thumbnail.NewMemoryCache(*originalCacheBytes)
+	}
+	switch *accessLog {
+	case "":
+	case "-":
+		imageProxy.AccessLog = os.Stdout
+	default:
+		f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		imageProxy.AccessLog = f
+	}
+	imageProxy.AccessLogSample = *accessLogSample
+	switch {
+	case *traceExporter == "":
+	case *traceExporter == "stdout":
+		imageProxy.Tracer = trace.NewTracer(trace.NewWriterExporter(os.Stdout))
+	case strings.HasPrefix(*traceExporter, "http://") || strings.HasPrefix(*traceExporter, "https://"):
+		otlpExporter = trace.NewOTLPExporter(*traceExporter, "fotomat", &http.Client{Timeout: 10 * time.Second})
+		imageProxy.Tracer = trace.NewTracer(otlpExporter)
+	default:
+		log.Fatalf("Bad trace_exporter %q", *traceExporter)
+	}
+	if imageProxy.Tracer != nil {
+		imageProxy.Tracer.Sample = *traceSample
+	}
 
-	http.Handle("/", thumbnail.NewProxy(director, pool, *maxPrefetch+*maxImageThreads, client))
+	publicMux.Handle("/", imageProxy)
 }
 
 func director(req *http.Request) (thumbnail.Options, int) {
+	c := currentConfig()
+
+	if len(c.signingKeys) > 0 {
+		path, ok := thumbnail.VerifyPath(c.signingKeys, req.URL.Path)
+		if !ok {
+			return thumbnail.Options{}, http.StatusForbidden
+		}
+		// The query isn't signed, so drop it rather than letting it
+		// vary the upstream request and bypass caches.
+		req.URL.Path, req.URL.RawQuery = path, ""
+	}
+
 	g := matchPath.FindStringSubmatch(req.URL.Path)
-	if len(g) != 7 {
+	if len(g) != 3 {
 		return thumbnail.Options{}, http.StatusBadRequest
 	}
 
-	if *localImageDirectory != "" {
-		req.URL.Scheme = "file"
-		req.URL.Host = "localhost"
+	defaults := c.defaults
+	var u *upstream
+	if len(c.routes) > 0 {
+		if u = match(c.routes, req.Host, g[1]); u == nil {
+			return thumbnail.Options{}, http.StatusNotFound
+		}
+		defaults = u.defaults
+	}
+
+	var o thumbnail.Options
+	if p := matchPreset.FindStringSubmatch(g[2]); len(p) == 2 {
+		var ok bool
+		if o, ok = c.presets[p[1]]; !ok {
+			return thumbnail.Options{}, http.StatusBadRequest
+		}
+	} else if c.presetsOnly {
+		return thumbnail.Options{}, http.StatusForbidden
+	} else {
+		var ok bool
+		if o, ok = c.parseOperation(g[2], defaults); !ok {
+			return thumbnail.Options{}, http.StatusBadRequest
+		}
+	}
+
+	// Disallow repeated scaling parameters.
+	if hasOperation(g[1]) {
+		return thumbnail.Options{}, http.StatusBadRequest
+	}
+
+	if u != nil {
+		u.rewrite(req.URL, g[1])
 	} else {
 		req.URL.Scheme = "http"
 		req.URL.Host = req.Host
+		req.URL.Path = g[1]
 	}
 
-	req.URL.Path = g[1]
-	preview := g[2] == "p"
-	webp := g[3] == "w"
-	crop := g[4] == "c"
-	width, _ := strconv.Atoi(g[5])
-	height, _ := strconv.Atoi(g[6])
+	return o, 0
+}
 
-	// Disallow repeated scaling parameters.
-	if matchPath.MatchString(req.URL.Path) {
-		return thumbnail.Options{}, http.StatusBadRequest
+// hasOperation returns true if path ends with an operation or preset.
+func hasOperation(path string) bool {
+	g := matchPath.FindStringSubmatch(path)
+	return len(g) == 3 && (matchOperation.MatchString(g[2]) || matchPreset.MatchString(g[2]))
+}
+
+// parseOperation returns the Options for an operation such as
+// "wc200x100-north", the part of a request path following the last "=",
+// starting from defaults.
+func (c *directorConfig) parseOperation(operation string, defaults thumbnail.Options) (thumbnail.Options, bool) {
+	g := matchOperation.FindStringSubmatch(operation)
+	if len(g) != 7 {
+		return thumbnail.Options{}, false
 	}
 
-	if width <= 0 || height <= 0 || width > *maxOutputDimension || height > *maxOutputDimension {
-		return thumbnail.Options{}, http.StatusBadRequest
+	preview := g[1] == "p"
+	webp := g[2] == "w"
+	crop := g[3] == "c"
+	pad := g[3] == "b"
+	width, _ := strconv.Atoi(g[4])
+	height, _ := strconv.Atoi(g[5])
+
+	if width <= 0 || height <= 0 || width > c.maxOutputDimension || height > c.maxOutputDimension {
+		return thumbnail.Options{}, false
 	}
 
-	o := thumbnail.Options{
-		Width:                 width,
-		Height:                height,
-		MaxBufferPixels:       *maxBufferPixels,
-		Sharpen:               *sharpen,
-		Crop:                  crop,
-		FastResize:            *fastResize,
-		MaxQueueDuration:      *maxQueueDuration,
-		MaxProcessingDuration: *maxProcessingDuration,
-		Save: format.SaveOptions{
-			Lossless:     *lossless,
-			LossyIfPhoto: *lossyIfPhoto,
-		},
+	o := defaults
+	o.Width = width
+	o.Height = height
+	o.Crop = crop
+	o.Pad = pad
+
+	if !parseModifiers(g[6], &o) {
+		return thumbnail.Options{}, false
 	}
 
 	if webp {
 		o.Save.AllowWebp = true
-		o.Save.Lossless = *losslessWebp
+		o.Save.Lossless = c.losslessWebp
 	}
 
 	// Preview images are tiny, blurry JPEGs/lossy WebPs.
@@ -100,7 +329,129 @@ func director(req *http.Request) (thumbnail.Options, int) {
 		o.Save.Quality = 40
 	}
 
-	return o, 0
+	return o, true
+}
+
+// parseModifiers applies the "-name" suffixes that may follow the size in
+// a request path to o.  Returns false if any is unknown or repeated.
+func parseModifiers(suffix string, o *thumbnail.Options) bool {
+	if suffix == "" {
+		return true
+	}
+
+	seen := map[string]bool{}
+	for _, name := range strings.Split(suffix[1:], "-") {
+		kind := "gravity"
+		if f := matchFocus.FindStringSubmatch(name); len(f) == 3 {
+			// Focal point, as fractions of width and height: "f0.5,0.25".
+			o.Gravity = thumbnail.GravityFocus
+			o.FocusX, _ = strconv.ParseFloat(f[1], 64)
+			o.FocusY, _ = strconv.ParseFloat(f[2], 64)
+			if o.FocusX > 1.0 || o.FocusY > 1.0 {
+				return false
+			}
+		} else if c := matchColor.FindStringSubmatch(name); len(c) == 5 {
+			// Pad background as hex RGB or RGBA: "bgffffff".
+			kind = "background"
+			bg := color.NRGBA{R: hexByte(c[1]), G: hexByte(c[2]), B: hexByte(c[3]), A: 255}
+			if c[4] != "" {
+				bg.A = hexByte(c[4])
+			}
+			o.Background = &bg
+		} else if e := matchEnlarge.FindStringSubmatch(name); len(e) == 2 {
+			// Allow enlarging, optionally limited to a factor: "up2".
+			kind = "enlarge"
+			o.Enlarge = true
+			if e[1] != "" {
+				o.MaxEnlarge, _ = strconv.ParseFloat(e[1], 64)
+				if o.MaxEnlarge < 1.0 {
+					return false
+				}
+			}
+		} else if gravity, ok := gravities[name]; ok {
+			o.Gravity = gravity
+		} else {
+			return false
+		}
+
+		if seen[kind] {
+			return false
+		}
+		seen[kind] = true
+	}
+
+	return true
+}
+
+// loadSigningKeys returns the URL signing keys in a comma-separated list
+// and a file with one per line, either of which may be empty.
+func loadSigningKeys(list, filename string) ([][]byte, error) {
+	var keys [][]byte
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	if filename == "" {
+		return keys, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Split(string(b), "\n") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	return keys, nil
+}
+
+// parseAllowlist parses a comma-separated list of IPs and CIDRs.
+func parseAllowlist(list string) ([]*net.IPNet, error) {
+	var allow []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			allow = append(allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_allowlist: bad IP or CIDR %q", s)
+		}
+		allow = append(allow, n)
+	}
+	return allow, nil
+}
+
+// checkRedirect only follows redirects to http and https upstreams, so a
+// malicious upstream can't redirect to a local file.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("Redirect to %s URL not allowed", req.URL.Scheme)
+	}
+	if len(via) >= 10 {
+		return errors.New("Stopped after 10 redirects")
+	}
+	return nil
+}
+
+func hexByte(s string) uint8 {
+	b, _ := strconv.ParseUint(s, 16, 8)
+	return uint8(b)
 }
 
 func init() {
@@ -7,11 +7,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"testing"
 
 	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/thumbnail"
 	"github.com/kitwalker12/fotomat/vips"
 	"github.com/stretchr/testify/assert"
 )
@@ -43,7 +45,7 @@ func init() {
 	// Record that address.
 	localhost = listen.Addr().String()
 
-	go http.Serve(listen, nil)
+	go http.Serve(listen, publicMux)
 }
 
 func TestSuccess(t *testing.T) {
@@ -58,6 +60,29 @@ func TestSuccess(t *testing.T) {
 
 	// Crop 3000x2000 PNG to a small preview JPEG.
 	assert.Nil(t, isSize("3000px.png=pc16x16", format.Jpeg, 16, 16))
+
+	// Crop JPEG using a gravity.
+	assert.Nil(t, isSize("watermelon.jpg=c200x100-north", format.Jpeg, 200, 100))
+	if vips.SmartcropSupported {
+		assert.Nil(t, isSize("watermelon.jpg=c200x100-attention", format.Jpeg, 200, 100))
+	} else {
+		assert.Equal(t, http.StatusBadRequest, status("watermelon.jpg=c200x100-attention"))
+	}
+
+	// Crop JPEG around a focal point.
+	assert.Nil(t, isSize("watermelon.jpg=c200x100-f0.5,.25", format.Jpeg, 200, 100))
+
+	// Scale animated GIF and convert to WebP.
+	assert.Nil(t, isSize("animated.gif=ws30x30", format.Webp, 30, 20))
+
+	// Enlarge JPEG, optionally up to a limit.
+	assert.Nil(t, isSize("watermelon.jpg=s1000x1000-up", format.Jpeg, 743, 1000))
+	assert.Nil(t, isSize("watermelon.jpg=s1000x1000-up1.5", format.Jpeg, 597, 804))
+
+	// Pad JPEG onto default, white, and transparent backgrounds.
+	assert.Nil(t, isSize("watermelon.jpg=b200x100", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg=b200x100-bgffffff", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg=b200x100-west-bg00000000", format.Png, 200, 100))
 }
 
 func TestResponseErrors(t *testing.T) {
@@ -101,6 +126,159 @@ func TestParameterValidation(t *testing.T) {
 
 	// Refuse repeated scale parameters.
 	assert.Equal(t, status("watermelon.jpg=s16x16=s16x16"), http.StatusBadRequest)
+
+	// Refuse unknown or repeated gravities.
+	assert.Equal(t, status("watermelon.jpg=c16x16-up"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c16x16-north-south"), http.StatusBadRequest)
+
+	// Refuse out of range or conflicting focal points.
+	assert.Equal(t, status("watermelon.jpg=c16x16-f1.5,0.5"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c16x16-f0.5"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c16x16-north-f0.5,0.5"), http.StatusBadRequest)
+
+	// Refuse enlarge factors below 1.
+	assert.Equal(t, status("watermelon.jpg=s16x16-up0.5"), http.StatusBadRequest)
+
+	// Refuse bad or repeated background colors.
+	assert.Equal(t, status("watermelon.jpg=b16x16-bgfff"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=b16x16-bgffffff-bg000000"), http.StatusBadRequest)
+}
+
+func TestSignedURLs(t *testing.T) {
+	defer useConfig(func(c *directorConfig) {
+		c.signingKeys = [][]byte{[]byte("new"), []byte("old")}
+	})()
+
+	// Accept URLs signed with any current key.
+	assert.Nil(t, isSize(thumbnail.SignPath([]byte("new"), "/watermelon.jpg=c200x100")[1:], format.Jpeg, 200, 100))
+	assert.Nil(t, isSize(thumbnail.SignPath([]byte("old"), "/watermelon.jpg=c100x100")[1:], format.Jpeg, 100, 100))
+
+	// Refuse unsigned, badly signed, and altered URLs.
+	assert.Equal(t, status("watermelon.jpg=c200x100"), http.StatusForbidden)
+	assert.Equal(t, status(thumbnail.SignPath([]byte("other"), "/watermelon.jpg=c200x100")[1:]), http.StatusForbidden)
+	assert.Equal(t, status(thumbnail.SignPath([]byte("new"), "/watermelon.jpg=c200x100")[1:]+"-north"), http.StatusForbidden)
+}
+
+func TestSignedURLQuery(t *testing.T) {
+	defer useConfig(func(c *directorConfig) {
+		c.signingKeys = [][]byte{[]byte("new")}
+		c.routes = nil
+	})()
+
+	// The query isn't signed, so it's dropped rather than passed
+	// upstream, where it could bypass caches.
+	r := &http.Request{Host: "origin.example.com", URL: &url.URL{
+		Path:     thumbnail.SignPath([]byte("new"), "/image.jpg=c200x100"),
+		RawQuery: "x=1",
+	}}
+	_, status := director(r)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "http://origin.example.com/image.jpg", r.URL.String())
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	f, err := ioutil.TempFile("", "fotomat-keys")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("three\n\nfour\n")
+	f.Close()
+
+	keys, err := loadSigningKeys("one, two", f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two"), []byte("three"), []byte("four")}, keys)
+
+	keys, err = loadSigningKeys("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(keys))
+
+	_, err = loadSigningKeys("", "/nonexistent/keys")
+	assert.NotNil(t, err)
+}
+
+func TestParseAllowlist(t *testing.T) {
+	allow, err := parseAllowlist(" 10.1.0.0/16, 127.0.0.1 ,fd00::1,")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(allow))
+	assert.Equal(t, "10.1.0.0/16", allow[0].String())
+	assert.Equal(t, "127.0.0.1/32", allow[1].String())
+	assert.Equal(t, "fd00::1/128", allow[2].String())
+
+	allow, err = parseAllowlist("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(allow))
+
+	_, err = parseAllowlist("10.1.0.0/33")
+	assert.NotNil(t, err)
+	_, err = parseAllowlist("internal.example.com")
+	assert.NotNil(t, err)
+}
+
+func TestPresets(t *testing.T) {
+	f, err := ioutil.TempFile("", "fotomat-presets")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+		"card": {"Operation": "c200x100-north", "Sharpen": true},
+		"thumb_png": {"Operation": "s100x100", "Format": "png"}
+	}`)
+	f.Close()
+
+	presets, err := loadPresets(currentConfig(), f.Name(), nil)
+	assert.Nil(t, err)
+	defer useConfig(func(c *directorConfig) { c.presets = presets })()
+	assert.True(t, presets["card"].Sharpen)
+	assert.Equal(t, thumbnail.GravityNorth, presets["card"].Gravity)
+
+	assert.Nil(t, isSize("watermelon.jpg=preset:card", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg=preset:thumb_png", format.Png, 75, 100))
+
+	// Refuse unknown or repeated presets.
+	assert.Equal(t, status("watermelon.jpg=preset:hero"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=preset:card=preset:card"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=s100x100=preset:card"), http.StatusBadRequest)
+
+	// Optionally refuse anything but presets.
+	defer useConfig(func(c *directorConfig) { c.presetsOnly = true })()
+	assert.Nil(t, isSize("watermelon.jpg=preset:card", format.Jpeg, 200, 100))
+	assert.Equal(t, status("watermelon.jpg=c200x100"), http.StatusForbidden)
+}
+
+func TestLoadPresetErrors(t *testing.T) {
+	for _, bad := range []string{
+		`{"card": {"Operation": "c200x100-nowhere"}}`,
+		`{"card": {"Operation": "c200x100", "Format": "bmp"}}`,
+		`{"card": {"Operation": "c200x100", "Quality": 101}}`,
+		`{"Card": {"Operation": "c200x100"}}`,
+		`{"card": "c200x100"}`,
+	} {
+		f, err := ioutil.TempFile("", "fotomat-presets")
+		if err != nil {
+			panic(err)
+		}
+		f.WriteString(bad)
+		f.Close()
+
+		_, err = loadPresets(currentConfig(), f.Name(), nil)
+		assert.NotNil(t, err, bad)
+		os.Remove(f.Name())
+	}
+
+	_, err := loadPresets(currentConfig(), "/nonexistent/presets.json", nil)
+	assert.NotNil(t, err)
+}
+
+// useConfig swaps in a copy of the current directorConfig modified by fn,
+// returning a function that restores the original.
+func useConfig(fn func(c *directorConfig)) func() {
+	old := currentConfig()
+	c := *old
+	fn(&c)
+	config.Store(&c)
+	return func() { config.Store(old) }
 }
 
 func isSize(filename string, f format.Format, width, height int) error {
@@ -3,26 +3,75 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof" // Adds http://*/debug/pprof/ to default mux.
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/kitwalker12/fotomat/vips"
 )
 
 var (
-	listenAddr = flag.String("listen", "127.0.0.1:3520", "[IP]:port to listen for incoming connections.")
+	drainTimeout = flag.Duration("drain_timeout", 30*time.Second, "How long to wait for requests in progress to finish when shutting down.")
+	listenAddr   = flag.String("listen", "127.0.0.1:3520", "[IP]:port to listen for incoming connections.")
 
 	postFns []func()
 )
 
 func main() {
 	flag.Parse()
+	if err := loadConfig(*configFile); err != nil {
+		log.Fatal(err)
+	}
 
 	// Allow more threads than that for networking, etc.
 	runtime.GOMAXPROCS(*maxImageThreads * 2)
 
 	postRun()
+	serveAdmin()
+
+	listener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{Handler: publicMux}
+	errCh := make(chan error, 1)
+	go func() { errCh <- server.Serve(listener) }()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-errCh:
+		log.Fatal(err)
+	case sig := <-sigCh:
+		log.Printf("Received %s, shutting down.", sig)
+	}
+
+	shutdown(server, listener)
+}
+
+// shutdown stops accepting connections, waits up to drain_timeout for
+// requests in progress to finish while /readyz reports that we're
+// draining, and then releases VIPS's resources.
+func shutdown(server *http.Server, listener net.Listener) {
+	server.SetKeepAlivesEnabled(false)
+	listener.Close()
 
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	if !imageProxy.Drain(*drainTimeout) {
+		log.Fatal("Timed out waiting for requests in progress to finish.")
+	}
+
+	closeAdmin()
+	imageProxy.Close()
+	if otlpExporter != nil {
+		otlpExporter.Close()
+	}
+	vips.Shutdown()
 }
 
 func post(fn func()) {
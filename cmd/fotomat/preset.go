@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/thumbnail"
+)
+
+var (
+	formats = map[string]format.Format{
+		"jpeg": format.Jpeg,
+		"png":  format.Png,
+		"gif":  format.Gif,
+		"webp": format.Webp,
+		"avif": format.Avif,
+	}
+)
+
+// preset is how a named preset is described in presets_file, eg:
+//
+//	{
+//	    "avatar": {"Operation": "c96x96-attention", "Sharpen": true},
+//	    "hero": {"Operation": "ws1600x900-up", "Quality": 90, "AllowAvif": true}
+//	}
+type preset struct {
+	// Operation uses the same syntax as a request, eg. "c200x100-north".
+	Operation string
+	overrides
+}
+
+// overrides are the settings that presets and routes can change from
+// their flags' values.
+type overrides struct {
+	// Sharpen, Lossless, and LossyIfPhoto override their flags if set.
+	Sharpen      *bool
+	Lossless     *bool
+	LossyIfPhoto *bool
+	// Quality is the JPEG, WebP, or AVIF quality (1-100).
+	Quality int
+	// Format forces an output format: "jpeg", "png", "gif", "webp", or
+	// "avif". If empty, it is chosen by content as usual.
+	Format string
+	// AllowAvif allows automatic selection of AVIF.
+	AllowAvif bool
+}
+
+// loadPresets reads named presets from a JSON file, if filename isn't
+// empty, adds those from the config file, and returns the Options for each.
+func loadPresets(c *directorConfig, filename string, configs map[string]preset) (map[string]thumbnail.Options, error) {
+	presets := map[string]thumbnail.Options{}
+	for name, p := range configs {
+		if err := addPreset(c, presets, name, p); err != nil {
+			return nil, fmt.Errorf("%s: %s", *configFile, err)
+		}
+	}
+
+	if filename == "" {
+		return presets, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]preset
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	for name, p := range raw {
+		if err := addPreset(c, presets, name, p); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+
+	return presets, nil
+}
+
+func addPreset(c *directorConfig, presets map[string]thumbnail.Options, name string, p preset) error {
+	if !matchPreset.MatchString("preset:" + name) {
+		return fmt.Errorf("preset %q: name must be lowercase letters, digits, or _", name)
+	}
+	if _, ok := presets[name]; ok {
+		return fmt.Errorf("preset %q: defined more than once", name)
+	}
+
+	o, err := p.options(c)
+	if err != nil {
+		return fmt.Errorf("preset %q: %s", name, err)
+	}
+
+	presets[name] = o
+	return nil
+}
+
+// options returns the Options described by p, starting from c's defaults.
+func (p preset) options(c *directorConfig) (thumbnail.Options, error) {
+	o, ok := c.parseOperation(p.Operation, c.defaults)
+	if !ok {
+		return thumbnail.Options{}, fmt.Errorf("bad operation %q", p.Operation)
+	}
+
+	if err := p.apply(&o); err != nil {
+		return thumbnail.Options{}, err
+	}
+
+	return o, nil
+}
+
+// apply changes o by any settings in v.
+func (v overrides) apply(o *thumbnail.Options) error {
+	if v.Sharpen != nil {
+		o.Sharpen = *v.Sharpen
+	}
+	if v.Lossless != nil {
+		o.Save.Lossless = *v.Lossless
+	}
+	if v.LossyIfPhoto != nil {
+		o.Save.LossyIfPhoto = *v.LossyIfPhoto
+	}
+
+	if v.Quality != 0 {
+		if v.Quality < 1 || v.Quality > 100 {
+			return fmt.Errorf("bad quality %d", v.Quality)
+		}
+		o.Save.Quality = v.Quality
+	}
+
+	if v.Format != "" {
+		f, ok := formats[v.Format]
+		if !ok {
+			return fmt.Errorf("bad format %q", v.Format)
+		}
+		o.Save.Format = f
+	}
+
+	if v.AllowAvif {
+		o.Save.AllowAvif = true
+	}
+
+	return nil
+}
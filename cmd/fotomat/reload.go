@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadableFlags only affect directorConfig, so they can be changed by
+// reload.  Changing any other flag requires a restart.
+var reloadableFlags = map[string]bool{
+	"fast_resize":             true,
+	"lossless":                true,
+	"lossless_webp":           true,
+	"lossy_if_photo":          true,
+	"max_buffer_pixels":       true,
+	"max_frames":              true,
+	"max_output_dimension":    true,
+	"max_processing_duration": true,
+	"max_queue_duration":      true,
+	"max_total_pixels":        true,
+	"presets_file":            true,
+	"presets_only":            true,
+	"routes_file":             true,
+	"sharpen":                 true,
+	"url_signing_key_file":    true,
+	"url_signing_keys":        true,
+}
+
+func reloadInit() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				log.Println("Reload failed, keeping previous settings:", err)
+			}
+		}
+	}()
+}
+
+// reload re-reads the config file and any files named by flags, and
+// atomically replaces the directorConfig used by new requests.  Flags given
+// on the command line still take precedence, and settings removed from
+// the config file revert to their defaults.
+func reload() error {
+	// The config file's name is itself a flag, which is reset below.
+	filename := *configFile
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	old := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { old[f.Name] = f.Value.String() })
+	oldPresetConfigs, oldRouteConfigs := presetConfigs, routeConfigs
+	restore := func() {
+		flag.VisitAll(func(f *flag.Flag) { f.Value.Set(old[f.Name]) })
+		presetConfigs, routeConfigs = oldPresetConfigs, oldRouteConfigs
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if !set[f.Name] {
+			f.Value.Set(f.DefValue)
+		}
+	})
+
+	*configFile = filename
+	if err := loadConfig(filename); err != nil {
+		restore()
+		return err
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if !reloadableFlags[f.Name] && f.Value.String() != old[f.Name] {
+			log.Printf("Changing %s from %q to %q requires a restart.", f.Name, old[f.Name], f.Value.String())
+			f.Value.Set(old[f.Name])
+		}
+	})
+
+	c, err := newDirectorConfig()
+	if err != nil {
+		restore()
+		return err
+	}
+
+	config.Store(c)
+	log.Println("Reloaded settings.")
+
+	return nil
+}
+
+func init() {
+	post(reloadInit)
+}
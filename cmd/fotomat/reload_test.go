@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/kitwalker12/fotomat/format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	oldConfig, oldPrefetch := currentConfig(), *maxPrefetch
+	defer func() {
+		flag.Set("config", "")
+		assert.Nil(t, reload())
+		config.Store(oldConfig)
+	}()
+
+	filename := writeConfig(`{
+	"sharpen": true,
+	"max_output_dimension": 100,
+	"max_prefetch": 1000,
+	"presets": {"card": {"Operation": "c200x100"}}
+}`)
+	defer os.Remove(filename)
+	flag.Set("config", filename)
+
+	// Director settings change, but those needing a restart don't.
+	assert.Nil(t, reload())
+	c := currentConfig()
+	assert.True(t, c.defaults.Sharpen)
+	assert.Equal(t, 100, c.maxOutputDimension)
+	assert.Equal(t, oldPrefetch, *maxPrefetch)
+	assert.Equal(t, status("watermelon.jpg=s200x200"), http.StatusBadRequest)
+	assert.Nil(t, isSize("watermelon.jpg=s100x100", format.Jpeg, 75, 100))
+
+	// Bad settings are refused, keeping the previous ones.
+	bad := writeConfig(`{
+	"max_output_dimension": 50,
+	"presets": {"card": {"Operation": "c200x100-nowhere"}}
+}`)
+	defer os.Remove(bad)
+	flag.Set("config", bad)
+	assert.NotNil(t, reload())
+	assert.Equal(t, c, currentConfig())
+	assert.Equal(t, 100, *maxOutputDimension)
+
+	// Removed settings revert to their defaults.
+	flag.Set("config", "")
+	assert.Nil(t, reload())
+	assert.False(t, currentConfig().defaults.Sharpen)
+	assert.Equal(t, 2048, currentConfig().maxOutputDimension)
+}
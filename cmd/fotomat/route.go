@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kitwalker12/fotomat/thumbnail"
+)
+
+// route is how a route is described in routes_file, eg:
+//
+//	[
+//	    {"Host": "img.example.com", "Upstream": "https://origin.example.com/images/"},
+//	    {"Prefix": "/avatars/", "Upstream": "file:///srv/avatars", "Sharpen": true}
+//	]
+type route struct {
+	// Host matches the request's Host header, ignoring any port.  If
+	// empty, any host matches.
+	Host string
+	// Prefix matches the start of the request path, and is replaced by
+	// Upstream's path.  Defaults to "/".
+	Prefix string
+	// Upstream is the base URL to fetch originals from: "http://...",
+	// "https://...", or "file:///some/directory".
+	Upstream string
+	// Default settings for requests on this route.  Presets ignore them.
+	overrides
+}
+
+// upstream is a route, ready to match requests.
+type upstream struct {
+	host     string
+	prefix   string
+	base     *url.URL
+	defaults thumbnail.Options
+}
+
+// loadRoutes reads routes from a JSON file, if filename isn't empty, adds
+// those from the config file, and returns them in the order they should be
+// tried: routes for a specific host first, then longest prefix first.
+func loadRoutes(c *directorConfig, filename string, configs []route) ([]*upstream, error) {
+	var routes []*upstream
+	for _, r := range configs {
+		u, err := r.upstream(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", *configFile, err)
+		}
+		routes = append(routes, u)
+	}
+
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		var raw []route
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+
+		for _, r := range raw {
+			u, err := r.upstream(c)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			routes = append(routes, u)
+		}
+	}
+
+	sort.Sort(byPriority(routes))
+
+	for i := 1; i < len(routes); i++ {
+		if routes[i].host == routes[i-1].host && routes[i].prefix == routes[i-1].prefix {
+			return nil, fmt.Errorf("route %s%s: defined more than once", routes[i].host, routes[i].prefix)
+		}
+	}
+
+	return routes, nil
+}
+
+func (r route) upstream(c *directorConfig) (*upstream, error) {
+	u := &upstream{host: strings.ToLower(r.Host), prefix: r.Prefix, defaults: c.defaults}
+
+	if u.prefix == "" {
+		u.prefix = "/"
+	}
+	if !strings.HasPrefix(u.prefix, "/") {
+		return nil, fmt.Errorf("route %s%s: prefix must start with /", r.Host, r.Prefix)
+	}
+	if !strings.HasSuffix(u.prefix, "/") {
+		u.prefix += "/"
+	}
+
+	base, err := url.Parse(r.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("route %s%s: %s", r.Host, r.Prefix, err)
+	}
+	switch base.Scheme {
+	case "http", "https":
+		if base.Host == "" {
+			return nil, fmt.Errorf("route %s%s: upstream %q has no host", r.Host, r.Prefix, r.Upstream)
+		}
+	case "file":
+		if base.Host != "" && base.Host != "localhost" {
+			return nil, fmt.Errorf("route %s%s: upstream %q must be a local directory", r.Host, r.Prefix, r.Upstream)
+		}
+		base.Host = "localhost"
+	default:
+		return nil, fmt.Errorf("route %s%s: upstream %q must be http, https, or file", r.Host, r.Prefix, r.Upstream)
+	}
+	base.RawQuery, base.Fragment = "", ""
+	u.base = base
+
+	if err := r.apply(&u.defaults); err != nil {
+		return nil, fmt.Errorf("route %s%s: %s", r.Host, r.Prefix, err)
+	}
+
+	return u, nil
+}
+
+// localRoute makes a route serving everything from a local directory, for
+// local_image_directory.
+func localRoute(c *directorConfig, dir string) (*upstream, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return route{Upstream: (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()}.upstream(c)
+}
+
+// match returns the first of routes matching host and path, or nil.
+func match(routes []*upstream, host, path string) *upstream {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, u := range routes {
+		if (u.host == "" || u.host == host) && strings.HasPrefix(path, u.prefix) {
+			return u
+		}
+	}
+	return nil
+}
+
+// rewrite points req at the original image for the request path name.
+func (u *upstream) rewrite(req *url.URL, name string) {
+	// Clean the rest of the path, so it can't escape a local directory.
+	rest := path.Clean("/" + strings.TrimPrefix(name, u.prefix))
+
+	req.Scheme = u.base.Scheme
+	req.Host = u.base.Host
+	req.Path = strings.TrimSuffix(u.base.Path, "/") + rest
+	if u.base.Scheme == "file" {
+		req.RawQuery = ""
+	}
+}
+
+// routeFiles is an http.FileSystem of just the local directories that the
+// current routes serve, so a file:// URL can't read anything else.
+type routeFiles struct{}
+
+func (routeFiles) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, u := range currentConfig().routes {
+		if u.base.Scheme != "file" {
+			continue
+		}
+		root := strings.TrimSuffix(u.base.Path, "/")
+		if name == root || strings.HasPrefix(name, root+"/") {
+			return http.Dir("/").Open(name)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+type byPriority []*upstream
+
+func (r byPriority) Len() int      { return len(r) }
+func (r byPriority) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byPriority) Less(i, j int) bool {
+	if (r[i].host == "") != (r[j].host == "") {
+		return r[i].host != ""
+	}
+	if len(r[i].prefix) != len(r[j].prefix) {
+		return len(r[i].prefix) > len(r[j].prefix)
+	}
+	if r[i].host != r[j].host {
+		return r[i].host < r[j].host
+	}
+	return r[i].prefix < r[j].prefix
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kitwalker12/fotomat/format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutes(t *testing.T) {
+	testdata, err := filepath.Abs("../../testdata")
+	assert.Nil(t, err)
+
+	routes, err := loadRoutes(currentConfig(), "", []route{
+		{Prefix: "/local", Upstream: "file://" + testdata, overrides: overrides{Format: "png"}},
+		{Host: "img.example.com", Upstream: "https://origin.example.com/images/"},
+		{Host: "img.example.com", Prefix: "/v2/", Upstream: "http://origin.example.com:8080"},
+	})
+	assert.Nil(t, err)
+	defer useConfig(func(c *directorConfig) { c.routes = routes })()
+
+	// Routes for a host come first, then longer prefixes.
+	assert.Equal(t, "img.example.com", routes[0].host)
+	assert.Equal(t, "/v2/", routes[0].prefix)
+	assert.Equal(t, "/", routes[1].prefix)
+	assert.Equal(t, "/local/", routes[2].prefix)
+
+	// Route defaults apply, and unrouted requests are refused.
+	assert.Nil(t, isSize("local/watermelon.jpg=s100x100", format.Png, 75, 100))
+	assert.Equal(t, http.StatusNotFound, status("watermelon.jpg=s100x100"))
+	assert.Equal(t, http.StatusNotFound, status("localwatermelon.jpg=s100x100"))
+
+	for in, out := range map[string]string{
+		"http://img.example.com:3520/v2/a/b.jpg=s100x100?x=1":    "http://origin.example.com:8080/a/b.jpg?x=1",
+		"http://IMG.example.com/c.jpg=s10x10":                    "https://origin.example.com/images/c.jpg",
+		"http://img.example.com/local/c.jpg=s10x10":              "https://origin.example.com/images/local/c.jpg",
+		"http://other.example.com/local/c.jpg=s10x10?x=1":        "file://localhost" + filepath.ToSlash(testdata) + "/c.jpg",
+		"http://other.example.com/local/../../etc/passwd=s10x10": "file://localhost" + filepath.ToSlash(testdata) + "/etc/passwd",
+	} {
+		req, _ := http.NewRequest("GET", in, nil)
+		_, status := director(req)
+		assert.Equal(t, 0, status, in)
+		assert.Equal(t, out, req.URL.String(), in)
+	}
+
+	req, _ := http.NewRequest("GET", "http://other.example.com/v2/c.jpg=s10x10", nil)
+	_, code := director(req)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestLoadRouteErrors(t *testing.T) {
+	c := currentConfig()
+	for _, bad := range []route{
+		{Prefix: "images/", Upstream: "http://origin.example.com"},
+		{Upstream: "ftp://origin.example.com"},
+		{Upstream: "http:///images"},
+		{Upstream: "file://origin.example.com/images"},
+		{Upstream: "%zz"},
+		{Upstream: "http://origin.example.com", overrides: overrides{Quality: 101}},
+		{Upstream: "http://origin.example.com", overrides: overrides{Format: "bmp"}},
+	} {
+		_, err := loadRoutes(c, "", []route{bad})
+		assert.NotNil(t, err, bad.Upstream)
+	}
+
+	// Routes must be unique.
+	_, err := loadRoutes(c, "", []route{
+		{Host: "a", Prefix: "/x", Upstream: "http://one"},
+		{Host: "a", Prefix: "/x/", Upstream: "http://two"},
+	})
+	assert.NotNil(t, err)
+
+	f, err := ioutil.TempFile("", "fotomat-routes")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"Upstream": "http://origin.example.com", "Sharpen": "yes"}]`)
+	f.Close()
+	_, err = loadRoutes(c, f.Name(), nil)
+	assert.NotNil(t, err)
+	_, err = loadRoutes(c, "/nonexistent/routes.json", nil)
+	assert.NotNil(t, err)
+
+	// Routes replace local_image_directory.
+	defer func() { routeConfigs = nil }()
+	routeConfigs = []route{{Upstream: "http://origin.example.com"}}
+	_, err = newDirectorConfig()
+	assert.NotNil(t, err)
+}
+
+func TestRouteFiles(t *testing.T) {
+	testdata, err := filepath.Abs("../../testdata")
+	if err != nil {
+		panic(err)
+	}
+	defer useConfig(func(c *directorConfig) {
+		c.routes = []*upstream{{base: &url.URL{Scheme: "file", Host: "localhost", Path: filepath.ToSlash(testdata) + "/"}}}
+	})()
+
+	f, err := routeFiles{}.Open(filepath.ToSlash(testdata) + "/watermelon.jpg")
+	if assert.Nil(t, err) {
+		f.Close()
+	}
+
+	// Nothing outside a route's directory can be read.
+	for _, name := range []string{"/etc/passwd", filepath.ToSlash(testdata) + "/../README.md", filepath.ToSlash(testdata) + "x/a.jpg"} {
+		_, err := routeFiles{}.Open(name)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	for _, good := range []string{"http://a/b.jpg", "https://a/b.jpg"} {
+		u, _ := url.Parse(good)
+		assert.Nil(t, checkRedirect(&http.Request{URL: u}, nil), good)
+	}
+
+	u, _ := url.Parse("file:///etc/passwd")
+	assert.NotNil(t, checkRedirect(&http.Request{URL: u}, nil))
+
+	u, _ = url.Parse("http://a/b.jpg")
+	assert.NotNil(t, checkRedirect(&http.Request{URL: u}, make([]*http.Request, 10)))
+}
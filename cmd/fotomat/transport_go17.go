@@ -0,0 +1,15 @@
+// +build go1.7
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/kitwalker12/fotomat/thumbnail"
+)
+
+// guardedTransport returns an http.Transport that only connects to
+// addresses guard allows.
+func guardedTransport(guard *thumbnail.AddressGuard) *http.Transport {
+	return &http.Transport{DialContext: guard.DialContext}
+}
@@ -1,6 +1,7 @@
 package format
 
 import (
+	"encoding/binary"
 	"errors"
 	"net/http"
 
@@ -24,22 +25,30 @@ const (
 	Png
 	Gif
 	Webp
+	Avif
 )
 
 var formatInfo = []struct {
 	mime      string
 	loadFile  func(filename string) (*vips.Image, error)
 	loadBytes func([]byte) (*vips.Image, error)
+	header    func([]byte) (Metadata, error)
 }{
-	{mime: "application/octet-stream", loadFile: nil, loadBytes: nil},
-	{mime: "image/jpeg", loadFile: vips.Jpegload, loadBytes: vips.JpegloadBuffer},
-	{mime: "image/png", loadFile: vips.Pngload, loadBytes: vips.PngloadBuffer},
-	{mime: "image/gif", loadFile: vips.Gifload, loadBytes: vips.GifloadBuffer},
-	{mime: "image/webp", loadFile: vips.Webpload, loadBytes: vips.WebploadBuffer},
+	{mime: "application/octet-stream", loadFile: nil, loadBytes: nil, header: nil},
+	{mime: "image/jpeg", loadFile: vips.Jpegload, loadBytes: vips.JpegloadBuffer, header: jpegHeader},
+	{mime: "image/png", loadFile: vips.Pngload, loadBytes: vips.PngloadBuffer, header: pngHeader},
+	{mime: "image/gif", loadFile: vips.Gifload, loadBytes: vips.GifloadBuffer, header: gifHeader},
+	{mime: "image/webp", loadFile: vips.Webpload, loadBytes: vips.WebploadBuffer, header: webpHeader},
+	{mime: "image/avif", loadFile: vips.Heifload, loadBytes: vips.HeifloadBuffer, header: nil},
 }
 
 // DetectFormat detects the Format of the supplied byte slice.
 func DetectFormat(blob []byte) Format {
+	// http.DetectContentType doesn't know about AVIF.
+	if isAvif(blob) {
+		return Avif
+	}
+
 	mime := http.DetectContentType(blob)
 
 	for format, info := range formatInfo {
@@ -51,6 +60,32 @@ func DetectFormat(blob []byte) Format {
 	return Unknown
 }
 
+// isAvif returns true if blob starts with an ISO base media file "ftyp" box
+// that lists an AVIF brand.
+func isAvif(blob []byte) bool {
+	if len(blob) < 16 || string(blob[4:8]) != "ftyp" {
+		return false
+	}
+
+	size := int(binary.BigEndian.Uint32(blob))
+	if size > len(blob) || size > 256 {
+		return false
+	}
+
+	// Major brand, then minor version, then compatible brands.
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue
+		}
+		switch string(blob[i : i+4]) {
+		case "avif", "avis":
+			return true
+		}
+	}
+
+	return false
+}
+
 // String returns the mime type of given image format.
 func (format Format) String() string {
 	return formatInfo[format].mime
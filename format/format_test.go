@@ -38,6 +38,23 @@ func TestMetadataValidation(t *testing.T) {
 	assert.Nil(t, isSize(image("2px.webp"), Webp, 2, 3))
 }
 
+func TestMetadataFrames(t *testing.T) {
+	m, err := MetadataBytes(image("2px.gif"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, 1, m.Frames)
+	}
+
+	// Only the first frame is loaded, but all frames are counted.
+	m, err = MetadataBytes(image("animated.gif"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, 60, m.Width)
+		assert.Equal(t, 40, m.Height)
+		if vips.AnimatedWebpSave {
+			assert.Equal(t, 3, m.Frames)
+		}
+	}
+}
+
 func metadataError(filename string) error {
 	_, err := MetadataBytes(image(filename))
 	return err
@@ -145,10 +162,59 @@ func TestSwitchToLossy(t *testing.T) {
 			thumb = convert(img, SaveOptions{Format: Webp, Lossless: true, LossyIfPhoto: true})
 			assert.Nil(t, isSize(thumb, Webp, 256, 169))
 			assert.Equal(t, lossyLen, len(thumb))
+
+			// Even when WebP is selected automatically.
+			thumb = convert(img, SaveOptions{AllowWebp: true, Lossless: true, LossyIfPhoto: true})
+			assert.Equal(t, lossyLen, len(thumb))
+
+			// And LossyWebp returns lossy regardless.
+			thumb = convert(img, SaveOptions{AllowWebp: true, Lossless: true, LossyWebp: true})
+			assert.Equal(t, lossyLen, len(thumb))
 		}
 	}
 }
 
+func TestDetectAvif(t *testing.T) {
+	assert.Equal(t, "image/avif", Avif.String())
+
+	// Major brand.
+	assert.Equal(t, Avif, DetectFormat([]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf")))
+
+	// Compatible brand.
+	assert.Equal(t, Avif, DetectFormat([]byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avif")))
+
+	// HEIC isn't AVIF.
+	assert.Equal(t, Unknown, DetectFormat([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")))
+
+	// Truncated box.
+	assert.Equal(t, Unknown, DetectFormat([]byte("\x00\x00\x00\x1cftypavif")))
+}
+
+func TestAvif(t *testing.T) {
+	if !vips.AvifSupported {
+		t.Skip("VIPS can't load and save AVIF")
+	}
+
+	for _, filename := range []string{"2px.jpg", "2px.png", "2px.gif", "2px.webp", "flowers.png", "watermelon.jpg"} {
+		img := image(filename)
+		m, err := MetadataBytes(img)
+		if !assert.Nil(t, err, "filename: %s", filename) {
+			continue
+		}
+
+		// Save as AVIF, and make sure we can read it back.
+		thumb := convert(img, SaveOptions{Format: Avif, Speed: 9})
+		if assert.Nil(t, isSize(thumb, Avif, m.Width, m.Height), "filename: %s", filename) {
+			thumb = convert(thumb, SaveOptions{})
+			assert.Nil(t, isSize(thumb, Jpeg, m.Width, m.Height), "filename: %s", filename)
+		}
+
+		// AllowAvif is preferred over AllowWebp.
+		thumb = convert(img, SaveOptions{AllowAvif: true, AllowWebp: true})
+		assert.Nil(t, isSize(thumb, Avif, m.Width, m.Height), "filename: %s", filename)
+	}
+}
+
 func convert(blob []byte, so SaveOptions) []byte {
 	format := DetectFormat(blob)
 	img, err := format.LoadBytes(blob)
@@ -0,0 +1,26 @@
+// Entry point for go-fuzz (https://github.com/dvyukov/go-fuzz), which
+// searches for inputs that crash or confuse MetadataHeader.  Copy
+// ../testdata/* to fuzz/corpus/ and run:
+// go-fuzz-build github.com/kitwalker12/fotomat/format
+// go-fuzz -bin=format-fuzz.zip -workdir=fuzz
+
+// +build gofuzz
+
+package format
+
+import (
+	"fmt"
+)
+
+// Fuzz parses data with MetadataHeader, and panics if it returns
+// nonsense.
+func Fuzz(data []byte) int {
+	m, err := MetadataHeader(data)
+	if err != nil {
+		return 0
+	}
+	if m.Width <= 0 || m.Height <= 0 || m.Frames < 1 || m.Format == Unknown {
+		panic(fmt.Sprintf("Invalid metadata %+v", m))
+	}
+	return 1
+}
@@ -0,0 +1,351 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// MetadataHeader parses just the header of an image byte slice, without
+// VIPS decoding it, and returns Metadata or an error.  It's much cheaper
+// than MetadataBytes, so images that are too large can be refused before
+// any memory is allocated for them, but it doesn't check that the rest of
+// the image is valid.
+func MetadataHeader(blob []byte) (Metadata, error) {
+	format := DetectFormat(blob)
+	if format == Unknown {
+		return Metadata{}, ErrUnknownFormat
+	}
+
+	return format.MetadataHeader(blob)
+}
+
+// MetadataHeader parses just the header of an image byte slice in known
+// format and returns Metadata or an error.  Returns ErrInvalidOperation
+// for formats whose headers it can't parse, such as AVIF.
+func (format Format) MetadataHeader(blob []byte) (Metadata, error) {
+	header := formatInfo[format].header
+	if header == nil {
+		return Metadata{}, ErrInvalidOperation
+	}
+
+	m, err := header(blob)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if m.Width <= 0 || m.Height <= 0 {
+		return Metadata{}, ErrUnknownFormat
+	}
+
+	// Match MetadataImage, which reports dimensions after rotation.
+	m.Width, m.Height = m.Orientation.Dimensions(m.Width, m.Height)
+	m.Format = format
+	if m.Frames < 1 {
+		m.Frames = 1
+	}
+
+	return m, nil
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegHeader reads the dimensions from a JPEG's start of frame marker, and
+// the orientation from an EXIF segment before it.
+func jpegHeader(blob []byte) (Metadata, error) {
+	if len(blob) < 2 || blob[0] != 0xff || blob[1] != 0xd8 {
+		return Metadata{}, ErrUnknownFormat
+	}
+
+	m := Metadata{}
+	for i := 2; ; {
+		// Markers may be padded with any number of 0xff fill bytes.
+		if i+1 >= len(blob) || blob[i] != 0xff {
+			return Metadata{}, ErrUnknownFormat
+		}
+		for i+1 < len(blob) && blob[i+1] == 0xff {
+			i++
+		}
+		if i+1 >= len(blob) {
+			return Metadata{}, ErrUnknownFormat
+		}
+		marker := blob[i+1]
+		i += 2
+
+		switch {
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8):
+			// Standalone markers have no length.
+			continue
+		case marker == 0xd9 || marker == 0xda:
+			// End of image or start of scan before start of frame.
+			return Metadata{}, ErrUnknownFormat
+		}
+
+		if i+2 > len(blob) {
+			return Metadata{}, ErrUnknownFormat
+		}
+		n := int(binary.BigEndian.Uint16(blob[i:]))
+		if n < 2 || i+n > len(blob) {
+			return Metadata{}, ErrUnknownFormat
+		}
+		segment := blob[i+2 : i+n]
+		i += n
+
+		switch {
+		case marker == 0xe1 && m.Orientation == Undefined && bytes.HasPrefix(segment, exifHeader):
+			m.Orientation = exifOrientation(segment[len(exifHeader):])
+		case isStartOfFrame(marker):
+			// Precision, height, width.  A height of 0 means it's
+			// defined later, which libjpeg doesn't support.
+			if len(segment) < 5 {
+				return Metadata{}, ErrUnknownFormat
+			}
+			m.Height = int(binary.BigEndian.Uint16(segment[1:]))
+			m.Width = int(binary.BigEndian.Uint16(segment[3:]))
+			return m, nil
+		}
+	}
+}
+
+// isStartOfFrame returns true for the baseline, progressive, lossless, and
+// arithmetic-coded SOFn markers.
+func isStartOfFrame(marker byte) bool {
+	return marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc
+}
+
+// exifOrientation reads the orientation tag from the first IFD of TIFF
+// formatted EXIF data, or returns Undefined.
+func exifOrientation(tiff []byte) Orientation {
+	if len(tiff) < 8 {
+		return Undefined
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return Undefined
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return Undefined
+	}
+
+	ifd := uint64(order.Uint32(tiff[4:]))
+	if ifd+2 > uint64(len(tiff)) {
+		return Undefined
+	}
+	i := int(ifd)
+
+	// Each entry is a tag, type, count, and value.
+	n := int(order.Uint16(tiff[i:]))
+	for i += 2; n > 0 && i+12 <= len(tiff); n, i = n-1, i+12 {
+		if order.Uint16(tiff[i:]) != 0x0112 {
+			continue
+		}
+		if order.Uint16(tiff[i+2:]) != 3 {
+			return Undefined
+		}
+		o := Orientation(order.Uint16(tiff[i+8:]))
+		if o <= Undefined || int(o) >= len(orientationInfo) {
+			return Undefined
+		}
+		return o
+	}
+
+	return Undefined
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngHeader reads the dimensions from a PNG's IHDR chunk, and transparency
+// and orientation from the chunks before the image data.
+func pngHeader(blob []byte) (Metadata, error) {
+	// Signature, then IHDR length and type, width, height, bit depth,
+	// and color type.
+	if len(blob) < 26 || !bytes.HasPrefix(blob, pngSignature) || string(blob[12:16]) != "IHDR" {
+		return Metadata{}, ErrUnknownFormat
+	}
+	w, h := binary.BigEndian.Uint32(blob[16:]), binary.BigEndian.Uint32(blob[20:])
+	if w > math.MaxInt32 || h > math.MaxInt32 {
+		return Metadata{}, ErrUnknownFormat
+	}
+
+	m := Metadata{Width: int(w), Height: int(h)}
+	switch blob[25] {
+	case 4, 6: // Gray and RGB with alpha.
+		m.HasAlpha = true
+	}
+
+	// Each chunk is a length, type, data, and CRC.
+chunks:
+	for i := len(pngSignature); i+8 <= len(blob); {
+		n := uint64(binary.BigEndian.Uint32(blob[i:]))
+		if n+12 > uint64(len(blob)-i) {
+			break
+		}
+		data := blob[i+8 : i+8+int(n)]
+
+		switch string(blob[i+4 : i+8]) {
+		case "IDAT":
+			break chunks
+		case "tRNS":
+			m.HasAlpha = true
+		case "eXIf":
+			m.Orientation = exifOrientation(data)
+		}
+
+		i += 12 + int(n)
+	}
+
+	return m, nil
+}
+
+// gifHeader reads the dimensions from a GIF's logical screen descriptor,
+// grown to fit any frame that extends beyond it as decoders do, and counts
+// its frames.
+func gifHeader(blob []byte) (Metadata, error) {
+	if len(blob) < 13 || (string(blob[:6]) != "GIF87a" && string(blob[:6]) != "GIF89a") {
+		return Metadata{}, ErrUnknownFormat
+	}
+
+	m := Metadata{
+		Width:  int(binary.LittleEndian.Uint16(blob[6:])),
+		Height: int(binary.LittleEndian.Uint16(blob[8:])),
+	}
+
+blocks:
+	for i := 13 + gifColorTableSize(blob[10]); i < len(blob); {
+		switch blob[i] {
+		case 0x21: // Extension
+			if i+1 >= len(blob) {
+				break blocks
+			}
+			// Graphic control extension with a transparent color.
+			if blob[i+1] == 0xf9 && i+3 < len(blob) && blob[i+3]&1 != 0 {
+				m.HasAlpha = true
+			}
+			i = gifSkipSubBlocks(blob, i+2)
+		case 0x2c: // Image descriptor
+			if i+10 > len(blob) {
+				break blocks
+			}
+			x := int(binary.LittleEndian.Uint16(blob[i+1:]))
+			y := int(binary.LittleEndian.Uint16(blob[i+3:]))
+			w := int(binary.LittleEndian.Uint16(blob[i+5:]))
+			h := int(binary.LittleEndian.Uint16(blob[i+7:]))
+			if x+w > m.Width {
+				m.Width = x + w
+			}
+			if y+h > m.Height {
+				m.Height = y + h
+			}
+			m.Frames++
+
+			// Skip local color table and LZW minimum code size.
+			i = gifSkipSubBlocks(blob, i+10+gifColorTableSize(blob[i+9])+1)
+		default: // Trailer, or garbage.
+			break blocks
+		}
+	}
+
+	if m.Frames == 0 {
+		return Metadata{}, ErrUnknownFormat
+	}
+
+	return m, nil
+}
+
+// gifColorTableSize returns the size of the color table described by the
+// packed fields of a logical screen or image descriptor.
+func gifColorTableSize(packed byte) int {
+	if packed&0x80 == 0 {
+		return 0
+	}
+	return 3 << (packed&7 + 1)
+}
+
+// gifSkipSubBlocks returns the offset after the data sub-blocks starting
+// at i, which may be past the end of blob.
+func gifSkipSubBlocks(blob []byte, i int) int {
+	for i < len(blob) {
+		n := int(blob[i])
+		i++
+		if n == 0 {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
+// webpHeader reads the dimensions from a WebP's VP8, VP8L, or VP8X chunk,
+// and for extended files, counts animation frames and reads orientation.
+func webpHeader(blob []byte) (Metadata, error) {
+	// RIFF header, then the first chunk's type, size, and data.
+	if len(blob) < 30 || string(blob[:4]) != "RIFF" || string(blob[8:12]) != "WEBP" {
+		return Metadata{}, ErrUnknownFormat
+	}
+	data := blob[20:]
+
+	m := Metadata{}
+	switch string(blob[12:16]) {
+	case "VP8 ":
+		// Frame tag, start code, then 14 bit width and height.
+		if string(data[3:6]) != "\x9d\x01\x2a" {
+			return Metadata{}, ErrUnknownFormat
+		}
+		m.Width = int(binary.LittleEndian.Uint16(data[6:]) & 0x3fff)
+		m.Height = int(binary.LittleEndian.Uint16(data[8:]) & 0x3fff)
+	case "VP8L":
+		// Signature, then 14 bit width-1 and height-1, and alpha hint.
+		if data[0] != 0x2f {
+			return Metadata{}, ErrUnknownFormat
+		}
+		bits := binary.LittleEndian.Uint32(data[1:])
+		m.Width = int(bits&0x3fff) + 1
+		m.Height = int(bits>>14&0x3fff) + 1
+		m.HasAlpha = bits>>28&1 != 0
+	case "VP8X":
+		// Flags, reserved, then 24 bit canvas width-1 and height-1.
+		flags := data[0]
+		m.Width = int(uint24(data[4:])) + 1
+		m.Height = int(uint24(data[7:])) + 1
+		m.HasAlpha = flags&0x10 != 0
+		if flags&0x0a != 0 {
+			webpChunks(blob, &m)
+		}
+	default:
+		return Metadata{}, ErrUnknownFormat
+	}
+
+	return m, nil
+}
+
+// webpChunks counts animation frames and reads the orientation from the
+// chunks of an extended WebP.
+func webpChunks(blob []byte, m *Metadata) {
+	// Each chunk is a type, size, and data padded to an even length.
+	for i := 12; i+8 <= len(blob); {
+		n := uint64(binary.LittleEndian.Uint32(blob[i+4:]))
+		if n+8 > uint64(len(blob)-i) {
+			return
+		}
+		data := blob[i+8 : i+8+int(n)]
+
+		switch string(blob[i : i+4]) {
+		case "ANMF":
+			m.Frames++
+		case "EXIF":
+			// Some encoders include JPEG's EXIF header.
+			m.Orientation = exifOrientation(bytes.TrimPrefix(data, exifHeader))
+		}
+
+		i += 8 + int(n) + int(n&1)
+	}
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
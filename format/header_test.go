@@ -0,0 +1,168 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var headerImages = []string{
+	"1px.png", "2px.gif", "2px.jpg", "2px.png", "2px.webp", "3000px.png",
+	"34000px.png", "animated.gif", "cmyk.jpg", "flowers.png", "noalpha.png",
+	"orient0.jpg", "orient1.jpg", "orient2.jpg", "orient3.jpg", "orient4.jpg",
+	"orient5.jpg", "orient6.jpg", "orient7.jpg", "orient8.jpg",
+	"somealpha.png", "watermelon.jpg",
+}
+
+func TestMetadataHeader(t *testing.T) {
+	// Agree with VIPS on every test image.
+	for _, filename := range headerImages {
+		want, err := MetadataBytes(image(filename))
+		if !assert.Nil(t, err, filename) {
+			continue
+		}
+		m, err := MetadataHeader(image(filename))
+		if assert.Nil(t, err, filename) {
+			assert.Equal(t, want.Width, m.Width, filename)
+			assert.Equal(t, want.Height, m.Height, filename)
+			assert.Equal(t, want.Format, m.Format, filename)
+			assert.Equal(t, want.Orientation, m.Orientation, filename)
+		}
+	}
+
+	m, err := MetadataHeader(image("animated.gif"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, 3, m.Frames)
+	}
+
+	m, err = MetadataHeader(image("somealpha.png"))
+	if assert.Nil(t, err) {
+		assert.True(t, m.HasAlpha)
+		assert.Equal(t, 1, m.Frames)
+	}
+}
+
+func TestMetadataHeaderErrors(t *testing.T) {
+	_, err := MetadataHeader(image("notimage.txt"))
+	assert.Equal(t, ErrUnknownFormat, err)
+
+	// Truncated before start of frame.
+	_, err = MetadataHeader(image("bad.jpg"))
+	assert.Equal(t, ErrUnknownFormat, err)
+
+	blob := image("2px.png")
+	for n := 0; n < 26; n++ {
+		_, err = Png.MetadataHeader(blob[:n])
+		assert.Equal(t, ErrUnknownFormat, err)
+	}
+
+	_, err = Avif.MetadataHeader(blob)
+	assert.Equal(t, ErrInvalidOperation, err)
+	_, err = Unknown.MetadataHeader(blob)
+	assert.Equal(t, ErrInvalidOperation, err)
+}
+
+func TestMetadataHeaderGif(t *testing.T) {
+	// A 20x30 frame on a 10x10 screen grows the screen.
+	gif := []byte("GIF89a\x0a\x00\x0a\x00\x00\x00\x00" +
+		"\x21\xf9\x04\x01\x00\x00\x00\x00" +
+		"\x2c\x00\x00\x00\x00\x14\x00\x1e\x00\x00\x02\x02\x4c\x01\x00" +
+		"\x3b")
+	m, err := MetadataHeader(gif)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 20, m.Width)
+		assert.Equal(t, 30, m.Height)
+		assert.Equal(t, 1, m.Frames)
+		assert.True(t, m.HasAlpha)
+	}
+
+	// No frames.
+	_, err = MetadataHeader([]byte("GIF87a\x0a\x00\x0a\x00\x00\x00\x00\x3b"))
+	assert.Equal(t, ErrUnknownFormat, err)
+}
+
+func TestMetadataHeaderWebp(t *testing.T) {
+	// Lossless 300x200 with alpha.
+	bits := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bits, 299|199<<14|1<<28)
+	m, err := MetadataHeader(riff(chunk("VP8L", append([]byte{0x2f}, append(bits, 0, 0, 0, 0, 0)...))))
+	if assert.Nil(t, err) {
+		assert.Equal(t, Webp, m.Format)
+		assert.Equal(t, 300, m.Width)
+		assert.Equal(t, 200, m.Height)
+		assert.True(t, m.HasAlpha)
+	}
+
+	// Animated 640x480 canvas with two frames, rotated by EXIF.
+	vp8x := []byte{0x0a, 0, 0, 0, 0x7f, 0x02, 0, 0xdf, 0x01, 0}
+	exif := []byte("II\x2a\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00")
+	anmf := make([]byte, 17)
+	m, err = MetadataHeader(riff(chunk("VP8X", vp8x), chunk("ANMF", anmf), chunk("ANMF", anmf), chunk("EXIF", exif)))
+	if assert.Nil(t, err) {
+		assert.Equal(t, 480, m.Width)
+		assert.Equal(t, 640, m.Height)
+		assert.Equal(t, 2, m.Frames)
+		assert.Equal(t, RightTop, m.Orientation)
+		assert.False(t, m.HasAlpha)
+	}
+}
+
+func TestMetadataHeaderFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for _, filename := range append(headerImages, "bad.jpg") {
+		blob := image(filename)
+
+		// Every truncation of the first 1KB.
+		for n := 0; n < len(blob) && n < 1024; n++ {
+			checkHeader(t, filename, blob[:n])
+		}
+
+		// Random corruption of the header.
+		for i := 0; i < 1000; i++ {
+			b := append([]byte{}, blob...)
+			n := len(b)
+			if n > 256 {
+				n = 256
+			}
+			for j := r.Intn(8); j >= 0; j-- {
+				b[r.Intn(n)] = byte(r.Intn(256))
+			}
+			checkHeader(t, filename, b)
+		}
+	}
+}
+
+// checkHeader fails if MetadataHeader returns nonsense for blob.  It's
+// also expected not to panic.
+func checkHeader(t *testing.T, filename string, blob []byte) {
+	m, err := MetadataHeader(blob)
+	if err != nil {
+		return
+	}
+	if m.Width <= 0 || m.Height <= 0 || m.Frames < 1 || m.Format == Unknown || m.Orientation < Undefined || m.Orientation > LeftBottom {
+		t.Errorf("%s: invalid %+v from %q", filename, m, blob)
+	}
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := bytes.Join(chunks, nil)
+	b := make([]byte, 8, 12+len(body))
+	copy(b, "RIFF")
+	binary.LittleEndian.PutUint32(b[4:], uint32(4+len(body)))
+	return append(append(b, "WEBP"...), body...)
+}
+
+func chunk(fourcc string, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data)+1)
+	copy(b, fourcc)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
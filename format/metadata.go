@@ -11,6 +11,8 @@ type Metadata struct {
 	Format      Format
 	Orientation Orientation
 	HasAlpha    bool
+	// Frames is the number of frames in an animated image, or 1.
+	Frames int
 }
 
 // MetadataBytes parses an image byte slice and returns Metadata or an error.
@@ -60,5 +62,21 @@ func MetadataImage(image *vips.Image) Metadata {
 	if w <= 0 || h <= 0 {
 		panic("Invalid image dimensions.")
 	}
-	return Metadata{Width: w, Height: h, Orientation: o, HasAlpha: image.HasAlpha()}
+	return Metadata{Width: w, Height: h, Orientation: o, HasAlpha: image.HasAlpha(), Frames: frames(image)}
+}
+
+// frames returns the number of frames in the file an Image was loaded from.
+func frames(image *vips.Image) int {
+	if n, ok := image.ImageGetInt(vips.MetaNPages); ok && n > 1 {
+		return n
+	}
+	return 1
+}
+
+// IsAnimated returns true if an Image contains several frames stacked
+// vertically, as loaded by vips.GifloadBufferPages or
+// vips.WebploadBufferPages.
+func IsAnimated(image *vips.Image) bool {
+	h, ok := image.ImageGetInt(vips.MetaPageHeight)
+	return ok && h > 0 && h < image.Ysize()
 }
@@ -11,6 +11,8 @@ const (
 	DefaultQuality = 85
 	// DefaultCompression is used when SaveOptions.Compression is unspecified.
 	DefaultCompression = 6
+	// DefaultSpeed is used when SaveOptions.Speed is unspecified.
+	DefaultSpeed = 5
 )
 
 // ErrInvalidSaveFormat is returned if the specified Format can't be written to.
@@ -19,13 +21,24 @@ var ErrInvalidSaveFormat = errors.New("Invalid save format")
 // SaveOptions specifies how an image should be saved.
 type SaveOptions struct {
 	// Format is the Format that an image is saved in. If unspecified, the best output format for a given input image is selected.
+	// Animated images are only kept animated when saved as Gif or Webp.
 	Format Format
-	// JPEG or WebP quality for an output image (1-100).
+	// JPEG, WebP, or AVIF quality for an output image (1-100).
 	Quality int
 	// Compress is the GZIP compression setting to use for PNG images (1-9).
 	Compression int
+	// Speed is the AVIF encoder speed, trading size for CPU time (1-9,
+	// slowest to fastest).  Unset (0) means DefaultSpeed, so VIPS's
+	// slowest setting of 0 isn't available.
+	Speed int
 	// AllowWebp allows automatic selection of WebP format, if reader can support it.
 	AllowWebp bool
+	// AllowAvif allows automatic selection of AVIF format, if reader can
+	// support it.  Preferred over WebP, except for animations.
+	AllowAvif bool
+	// LossyWebp disables lossless WebP and AVIF when they're selected
+	// automatically by AllowWebp or AllowAvif.
+	LossyWebp bool
 	// Lossless allows selection of a lossless output format.
 	Lossless bool
 	// LossyIfPhoto uses a lossy format if it detects that an image is a photo.
@@ -42,16 +55,29 @@ func Save(image *vips.Image, options SaveOptions) ([]byte, error) {
 		options.Compression = DefaultCompression
 	}
 
+	if options.Speed < 1 || options.Speed > 9 {
+		options.Speed = DefaultSpeed
+	}
+
 	// Make a decision on image format and whether we're using lossless.
 	if options.Format == Unknown {
-		if options.AllowWebp {
+		if options.AllowAvif && vips.AvifSupported && !IsAnimated(image) {
+			options.Format = Avif
+		} else if options.AllowWebp {
 			options.Format = Webp
+		} else if IsAnimated(image) {
+			options.Format = Gif
 		} else if image.HasAlpha() || useLossless(image, options) {
 			options.Format = Png
 		} else {
 			options.Format = Jpeg
 		}
-	} else if options.Format == Webp && !useLossless(image, options) {
+
+		if (options.Format == Webp || options.Format == Avif) && options.LossyWebp {
+			options.Lossless = false
+		}
+	}
+	if (options.Format == Webp || options.Format == Avif) && !useLossless(image, options) {
 		options.Lossless = false
 	}
 
@@ -60,8 +86,12 @@ func Save(image *vips.Image, options SaveOptions) ([]byte, error) {
 		return jpegSave(image, options)
 	case Png:
 		return pngSave(image, options)
+	case Gif:
+		return gifSave(image, options)
 	case Webp:
 		return webpSave(image, options)
+	case Avif:
+		return avifSave(image, options)
 	default:
 		return nil, ErrInvalidSaveFormat
 	}
@@ -85,10 +115,18 @@ func pngSave(image *vips.Image, options SaveOptions) ([]byte, error) {
 	return image.PngsaveBuffer(true, options.Compression, false)
 }
 
+func gifSave(image *vips.Image, options SaveOptions) ([]byte, error) {
+	return image.GifsaveBuffer()
+}
+
 func webpSave(image *vips.Image, options SaveOptions) ([]byte, error) {
 	return image.WebpsaveBuffer(options.Quality, options.Lossless)
 }
 
+func avifSave(image *vips.Image, options SaveOptions) ([]byte, error) {
+	return image.HeifsaveBuffer(options.Quality, options.Lossless, vips.HeifCompressionAv1, options.Speed)
+}
+
 func useLossless(image *vips.Image, options SaveOptions) bool {
 	if !options.Lossless {
 		return false
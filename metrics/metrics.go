@@ -0,0 +1,281 @@
+// Package metrics provides counters, gauges, and histograms that can be
+// exported in the Prometheus text format, without any dependencies.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are histogram buckets suitable for durations in seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// SizeBuckets are histogram buckets suitable for sizes in bytes.
+var SizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+// Default is the Registry that the package-level constructors add to.
+var Default = NewRegistry()
+
+// Registry is a set of named metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+type described struct {
+	help   string
+	kind   string
+	metric metric
+}
+
+func (d described) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(d.help), name, d.kind)
+	d.metric.write(w, name)
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) add(name, help, kind string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.metrics[name] = described{help: help, kind: kind, metric: m}
+}
+
+// WriteText writes every metric in r to w in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	b := bufio.NewWriter(w)
+	for i, m := range metrics {
+		m.write(b, names[i])
+	}
+	return b.Flush()
+}
+
+// ServeHTTP serves r in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	bits uint64
+}
+
+// NewCounter creates a Counter in r.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.add(name, help, "counter", c)
+	return c
+}
+
+// NewCounter creates a Counter in Default.
+func NewCounter(name, help string) *Counter {
+	return Default.NewCounter(name, help)
+}
+
+// Inc adds one to c.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to c.
+func (c *Counter) Add(v float64) {
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current value of c.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(c.Value()))
+}
+
+// CounterVec is a set of Counters distinguished by the value of a label.
+type CounterVec struct {
+	label    string
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec creates a CounterVec in r.
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	r.add(name, help, "counter", v)
+	return v
+}
+
+// NewCounterVec creates a CounterVec in Default.
+func NewCounterVec(name, help, label string) *CounterVec {
+	return Default.NewCounterVec(name, help, label)
+}
+
+// With returns the Counter for a label value, creating it if needed.
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.counters[value]
+	if !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.counters))
+	for value := range v.counters {
+		values = append(values, value)
+	}
+	v.mu.Unlock()
+
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, v.label, escapeLabel(value), formatFloat(v.With(value).Value()))
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+// NewGauge creates a Gauge in r.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.add(name, help, "gauge", g)
+	return g
+}
+
+// NewGauge creates a Gauge in Default.
+func NewGauge(name, help string) *Gauge {
+	return Default.NewGauge(name, help)
+}
+
+// Add adds v, which may be negative, to g.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Set sets g to v.
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Value returns the current value of g.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(g.Value()))
+}
+
+// Histogram counts observations in buckets by their upper bound.
+type Histogram struct {
+	sumBits uint64
+	count   uint64
+	buckets []float64
+	counts  []uint64
+}
+
+// NewHistogram creates a Histogram in r with the given bucket upper
+// bounds, in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.add(name, help, "histogram", h)
+	return h
+}
+
+// NewHistogram creates a Histogram in Default.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+// Observe adds an observation of v to h.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	addFloat(&h.sumBits, v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	// Read count first, so buckets are never larger than it.
+	count := atomic.LoadUint64(&h.count)
+	sum := math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		if cumulative > count {
+			cumulative = count
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A test counter.")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 100; j++ {
+				c.Inc()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	c.Add(0.5)
+
+	assert.Equal(t, 1000.5, c.Value())
+	assert.Equal(t, "# HELP test_total A test counter.\n# TYPE test_total counter\ntest_total 1000.5\n", text(r))
+
+	// Names must be unique.
+	assert.Panics(t, func() { r.NewGauge("test_total", "Again.") })
+}
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("test_total", "Line one\nline two.", "status")
+	v.With("500").Inc()
+	v.With("200").Add(2)
+	v.With("a\"b\\c").Inc()
+
+	assert.Equal(t, float64(2), v.With("200").Value())
+	assert.Equal(t, `# HELP test_total Line one\nline two.
+# TYPE test_total counter
+test_total{status="200"} 2
+test_total{status="500"} 1
+test_total{status="a\"b\\c"} 1
+`, text(r))
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("test_active", "A test gauge.")
+	g.Add(3)
+	g.Add(-1)
+	assert.Equal(t, float64(2), g.Value())
+	g.Set(-7)
+	assert.Equal(t, "# HELP test_active A test gauge.\n# TYPE test_active gauge\ntest_active -7\n", text(r))
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("test_seconds", "A test histogram.", []float64{0.1, 1, 10})
+	for _, v := range []float64{0.05, 0.1, 0.5, 5, 50} {
+		h.Observe(v)
+	}
+
+	assert.Equal(t, `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="10"} 4
+test_seconds_bucket{le="+Inf"} 5
+test_seconds_sum 55.65
+test_seconds_count 5
+`, text(r))
+}
+
+func TestRegistryOrder(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("b", "B.")
+	r.NewCounter("a", "A.")
+	r.NewCounter("c", "C.")
+
+	assert.Equal(t, "# HELP a A.\n# TYPE a counter\na 0\n# HELP b B.\n# TYPE b gauge\nb 0\n# HELP c C.\n# TYPE c counter\nc 0\n", text(r))
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A test counter.").Inc()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "test_total 1\n")
+}
+
+func text(r *Registry) string {
+	var b bytes.Buffer
+	if err := r.WriteText(&b); err != nil {
+		panic(err)
+	}
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package thumbnail
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/kitwalker12/fotomat/format"
+)
+
+// accessLogEntry is one line of the JSON access log.  Durations are in
+// milliseconds.
+type accessLogEntry struct {
+	Time           string          `json:"time"`
+	Client         string          `json:"client"`
+	Method         string          `json:"method"`
+	Path           string          `json:"path"`
+	TraceID        string          `json:"trace_id,omitempty"`
+	Options        json.RawMessage `json:"options,omitempty"`
+	Status         int             `json:"status"`
+	Error          string          `json:"error,omitempty"`
+	Duration       float64         `json:"duration_ms"`
+	CacheHit       bool            `json:"cache_hit,omitempty"`
+	UpstreamStatus int             `json:"upstream_status,omitempty"`
+	Upstream       float64         `json:"upstream_ms,omitempty"`
+	Queue          float64         `json:"queue_ms,omitempty"`
+	PoolWait       float64         `json:"pool_wait_ms,omitempty"`
+	Processing     float64         `json:"processing_ms,omitempty"`
+	InputFormat    string          `json:"input_format,omitempty"`
+	InputWidth     int             `json:"input_width,omitempty"`
+	InputHeight    int             `json:"input_height,omitempty"`
+	OutputFormat   string          `json:"output_format,omitempty"`
+	OutputBytes    int             `json:"output_bytes,omitempty"`
+}
+
+// resultStats describes how a proxyResult was made, for the access log.
+type resultStats struct {
+	upstreamStatus int
+	upstream       time.Duration
+	queue          time.Duration
+	poolWait       time.Duration
+	processing     time.Duration
+	input          *format.Metadata
+	output         format.Format
+}
+
+func (a *accessLogEntry) setOptions(o Options) {
+	if j, err := o.ToJSON(); err == nil {
+		a.Options = j
+	}
+}
+
+func (a *accessLogEntry) setResult(r *proxyResult) {
+	if r.err != nil {
+		a.Error = r.err.Error()
+	}
+
+	s := r.stats
+	a.UpstreamStatus = s.upstreamStatus
+	a.Upstream = milliseconds(s.upstream)
+	a.Queue = milliseconds(s.queue)
+	a.PoolWait = milliseconds(s.poolWait)
+	a.Processing = milliseconds(s.processing)
+	if s.input != nil {
+		a.InputFormat = s.input.Format.String()
+		a.InputWidth = s.input.Width
+		a.InputHeight = s.input.Height
+	}
+	if r.blob != nil {
+		a.OutputFormat = s.output.String()
+		a.OutputBytes = len(r.blob)
+	}
+}
+
+// logAccess writes a to AccessLog, if it's set and this request is
+// sampled.  Failed requests are always logged.
+func (p *Proxy) logAccess(a *accessLogEntry, w *statusWriter, or *http.Request, start time.Time) {
+	if p.AccessLog == nil {
+		return
+	}
+
+	a.Status = w.code()
+	if a.Status < 400 && rand.Float64() >= p.AccessLogSample {
+		return
+	}
+
+	a.Time = start.UTC().Format(time.RFC3339Nano)
+	a.Client = or.RemoteAddr
+	a.Method = or.Method
+	a.Duration = milliseconds(time.Since(start))
+
+	line, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	// Write each line in one call, so lines aren't interleaved.
+	p.logMu.Lock()
+	p.AccessLog.Write(line)
+	p.logMu.Unlock()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
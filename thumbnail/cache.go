@@ -0,0 +1,224 @@
+package thumbnail
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores generated thumbnails for Proxy.  Implementations must be
+// safe for concurrent use, and must not return entries that have expired.
+type Cache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+}
+
+// CacheEntry is a generated thumbnail along with the response headers it
+// was served with.
+type CacheEntry struct {
+	Blob   []byte
+	Header http.Header
+	// Date is when the original image was fetched, less its upstream Age.
+	Date time.Time
+	// Expires is when this entry should no longer be served.
+	Expires time.Time
+}
+
+// CacheStats counts Cache operations.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Bytes     int64
+}
+
+// MemoryCache is a Cache that keeps up to a maximum number of bytes of
+// the most recently used entries in RAM.  Must be created with
+// NewMemoryCache.
+type MemoryCache struct {
+	maxBytes int64
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	stats    CacheStats
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+	size  int64
+}
+
+// NewMemoryCache creates a MemoryCache holding up to maxBytes of entries.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored under key, if present and not expired.
+func (c *MemoryCache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if ok && !time.Now().Before(e.Value.(*memoryCacheItem).entry.Expires) {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*memoryCacheItem).entry, true
+}
+
+// Set stores entry under key, evicting least recently used entries to
+// make room.  Entries larger than the whole cache are ignored.
+func (c *MemoryCache) Set(key string, entry *CacheEntry) {
+	item := &memoryCacheItem{key: key, entry: entry, size: entrySize(key, entry)}
+	if item.size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	for c.stats.Bytes+item.size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+
+	c.entries[key] = c.lru.PushFront(item)
+	c.stats.Entries++
+	c.stats.Bytes += item.size
+}
+
+// Stats returns counts of operations on, and the current size of, c.
+func (c *MemoryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+func (c *MemoryCache) remove(e *list.Element) {
+	item := c.lru.Remove(e).(*memoryCacheItem)
+	delete(c.entries, item.key)
+	c.stats.Entries--
+	c.stats.Bytes -= item.size
+}
+
+// entrySize estimates the RAM used by an entry.
+func entrySize(key string, entry *CacheEntry) int64 {
+	size := len(key) + len(entry.Blob)
+	for k, v := range entry.Header {
+		size += len(k)
+		for _, s := range v {
+			size += len(s)
+		}
+	}
+	return int64(size)
+}
+
+// TieredCache is a Cache that checks each of its Caches in order, such as
+// a small MemoryCache in front of a large DiskCache.  Hits are copied into
+// the earlier Caches that missed.
+type TieredCache []Cache
+
+// Get returns the entry stored under key in the first Cache that has it.
+func (t TieredCache) Get(key string) (*CacheEntry, bool) {
+	for i, c := range t {
+		if entry, ok := c.Get(key); ok {
+			for _, earlier := range t[:i] {
+				earlier.Set(key, entry)
+			}
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// Set stores entry under key in every Cache.
+func (t TieredCache) Set(key string, entry *CacheEntry) {
+	for _, c := range t {
+		c.Set(key, entry)
+	}
+}
+
+// cacheKey returns the key that a thumbnail of url generated using o is
+// stored under, distinguishing negotiated variants since their Etags differ.
+func cacheKey(url, variant string, o Options) (string, error) {
+	j, err := o.ToJSON()
+	if err != nil {
+		return "", err
+	}
+
+	return url + " " + variant + " " + string(j), nil
+}
+
+// cacheLifetime returns how long a response with upstream headers h may
+// be cached for, according to its Cache-Control or Expires headers.
+func cacheLifetime(h http.Header, now time.Time) time.Duration {
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if _, ok := cc["private"]; ok {
+		return 0
+	}
+
+	maxAge, err := strconv.Atoi(cc["s-maxage"])
+	if err != nil {
+		maxAge, err = strconv.Atoi(cc["max-age"])
+	}
+	if err == nil {
+		age, _ := strconv.Atoi(h.Get("Age"))
+		return time.Duration(maxAge-age) * time.Second
+	}
+
+	expires, err := http.ParseTime(h.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	return expires.Sub(date)
+}
+
+// cacheControl returns the directives in h's Cache-Control header.
+func cacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, directive := range strings.Split(strings.ToLower(h.Get("Cache-Control")), ",") {
+		kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		if len(kv) == 2 {
+			cc[kv[0]] = strings.Trim(kv[1], `"`)
+		} else {
+			cc[kv[0]] = ""
+		}
+	}
+	return cc
+}
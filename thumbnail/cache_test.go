@@ -0,0 +1,78 @@
+package thumbnail
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCache(t *testing.T) {
+	expires := time.Now().Add(time.Minute)
+	entry := func(size int) *CacheEntry {
+		return &CacheEntry{Blob: make([]byte, size), Expires: expires}
+	}
+
+	c := NewMemoryCache(300)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", entry(99))
+	c.Set("b", entry(99))
+	c.Set("c", entry(99))
+	e, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 99, len(e.Blob))
+
+	// Adding "d" should evict "b", the least recently used.
+	c.Set("d", entry(99))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok = c.Get(key)
+		assert.True(t, ok, key)
+	}
+
+	// Entries larger than the whole cache are ignored.
+	c.Set("e", entry(1000))
+	_, ok = c.Get("e")
+	assert.False(t, ok)
+
+	// Expired entries are never returned.
+	c.Set("f", &CacheEntry{Blob: make([]byte, 10), Expires: time.Now().Add(-time.Second)})
+	_, ok = c.Get("f")
+	assert.False(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(4), stats.Hits)
+	assert.Equal(t, int64(4), stats.Misses)
+	assert.Equal(t, int64(2), stats.Evictions)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(200), stats.Bytes)
+}
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Now()
+	date := now.UTC().Format(http.TimeFormat)
+	expires := now.Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	for _, test := range []struct {
+		header   http.Header
+		lifetime time.Duration
+	}{
+		{http.Header{}, 0},
+		{http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{http.Header{"Cache-Control": {"public, max-age=60"}, "Age": {"20"}}, 40 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute},
+		{http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0},
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, 0},
+		{http.Header{"Cache-Control": {"no-store"}}, 0},
+		{http.Header{"Date": {date}, "Expires": {expires}}, time.Hour},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Expires": {expires}}, time.Minute},
+		{http.Header{"Expires": {"0"}}, 0},
+	} {
+		assert.Equal(t, test.lifetime, cacheLifetime(test.header, now), "%v", test.header)
+	}
+}
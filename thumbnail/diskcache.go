@@ -0,0 +1,305 @@
+package thumbnail
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskCacheTempPrefix = ".tmp-"
+	diskCacheShardLen   = 2
+)
+
+// DiskCache is a Cache that keeps up to a maximum number of bytes of the
+// most recently used entries in a directory, so they survive restarts.
+// Entries are spread over subdirectories named after the first bytes of
+// the hash of their key, and written atomically. Must be created with
+// NewDiskCache.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	stats    CacheStats
+}
+
+type diskCacheItem struct {
+	name string
+	size int64
+	used time.Time
+}
+
+// diskCacheHeader is stored as the first line of each file, followed by
+// the thumbnail itself.
+type diskCacheHeader struct {
+	Key     string
+	Header  http.Header
+	Date    time.Time
+	Expires time.Time
+}
+
+// NewDiskCache creates a DiskCache holding up to maxBytes of entries in
+// dir, indexing any entries left there by a previous run. If dir already
+// holds more than maxBytes, the least recently used entries are removed.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	var items diskCacheItems
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name := filepath.Base(path)
+		if strings.HasPrefix(name, diskCacheTempPrefix) {
+			// Left over from an interrupted write.
+			return os.Remove(path)
+		}
+		if len(name) != 2*sha1.Size || c.path(name) != path {
+			return nil
+		}
+		items = append(items, &diskCacheItem{name: name, size: info.Size(), used: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Most recently used at the front.
+	sort.Sort(items)
+	for _, item := range items {
+		c.entries[item.name] = c.lru.PushBack(item)
+		c.stats.Entries++
+		c.stats.Bytes += item.size
+	}
+
+	c.mu.Lock()
+	c.evict(0)
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// Get returns the entry stored under key, if present and not expired.
+func (c *DiskCache) Get(key string) (*CacheEntry, bool) {
+	name := diskCacheName(key)
+
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+
+	var entry *CacheEntry
+	var fi os.FileInfo
+	if ok {
+		entry, fi = c.read(name, key)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry == nil {
+		// A concurrent Set may have replaced the file or its index
+		// entry since it was read, so only remove the ones read.
+		if ok && c.entries[name] == e {
+			c.unindex(name)
+			if cur, err := os.Stat(c.path(name)); err == nil && fi != nil && os.SameFile(fi, cur) {
+				os.Remove(c.path(name))
+			}
+		}
+		c.stats.Misses++
+		return nil, false
+	}
+
+	// Record use in the file's mtime, so LRU order survives restarts.
+	now := time.Now()
+	os.Chtimes(c.path(name), now, now)
+
+	c.stats.Hits++
+	return entry, true
+}
+
+// Set stores entry under key, evicting least recently used entries to
+// make room. Entries larger than the whole cache are ignored.
+func (c *DiskCache) Set(key string, entry *CacheEntry) {
+	if int64(len(entry.Blob)) > c.maxBytes {
+		return
+	}
+
+	name := diskCacheName(key)
+
+	size, err := c.write(name, key, entry)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unindex(name)
+
+	if size > c.maxBytes {
+		os.Remove(c.path(name))
+		return
+	}
+
+	c.evict(size)
+
+	c.entries[name] = c.lru.PushFront(&diskCacheItem{name: name, size: size, used: time.Now()})
+	c.stats.Entries++
+	c.stats.Bytes += size
+}
+
+// Stats returns counts of operations on, and the current size of, c.
+func (c *DiskCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// evict removes least recently used entries until there is room for size
+// more bytes. Must be called with c.mu held.
+func (c *DiskCache) evict(size int64) {
+	for c.lru.Len() > 0 && c.stats.Bytes+size > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*diskCacheItem).name)
+		c.stats.Evictions++
+	}
+}
+
+// remove deletes an entry from the index and disk. Must be called with
+// c.mu held.
+func (c *DiskCache) remove(name string) {
+	c.unindex(name)
+	os.Remove(c.path(name))
+}
+
+// unindex deletes an entry from the index only. Must be called with c.mu
+// held.
+func (c *DiskCache) unindex(name string) {
+	if e, ok := c.entries[name]; ok {
+		item := c.lru.Remove(e).(*diskCacheItem)
+		delete(c.entries, name)
+		c.stats.Entries--
+		c.stats.Bytes -= item.size
+	}
+}
+
+// read loads an entry from disk, returning nil if it is unreadable, was
+// stored under a different key, or has expired.  Also returns the info of
+// the file opened, if any.
+func (c *DiskCache) read(name, key string) (*CacheEntry, os.FileInfo) {
+	f, err := os.Open(c.path(name))
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil
+	}
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fi
+	}
+
+	var h diskCacheHeader
+	if err := json.Unmarshal(line, &h); err != nil || h.Key != key || !time.Now().Before(h.Expires) {
+		return nil, fi
+	}
+
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fi
+	}
+
+	return &CacheEntry{Blob: blob, Header: h.Header, Date: h.Date, Expires: h.Expires}, fi
+}
+
+// write stores an entry on disk via a temporary file and rename, so
+// readers never see a partial entry. Returns the size of the file.
+func (c *DiskCache) write(name, key string, entry *CacheEntry) (int64, error) {
+	line, err := json.Marshal(diskCacheHeader{Key: key, Header: entry.Header, Date: entry.Date, Expires: entry.Expires})
+	if err != nil {
+		return 0, err
+	}
+
+	path := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), diskCacheTempPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := writeAll(f, line, []byte{'\n'}, entry.Blob)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (c *DiskCache) path(name string) string {
+	return filepath.Join(c.dir, name[:diskCacheShardLen], name[diskCacheShardLen:2*diskCacheShardLen], name)
+}
+
+func writeAll(w io.Writer, bufs ...[]byte) (int64, error) {
+	var size int64
+	for _, buf := range bufs {
+		n, err := w.Write(buf)
+		size += int64(n)
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+// diskCacheName returns the filename an entry with key is stored under.
+func diskCacheName(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// diskCacheItems sorts most recently used first.
+type diskCacheItems []*diskCacheItem
+
+func (d diskCacheItems) Len() int           { return len(d) }
+func (d diskCacheItems) Less(i, j int) bool { return d[i].used.After(d[j].used) }
+func (d diskCacheItems) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,124 @@
+package thumbnail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fotomat-cache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expires := time.Now().Add(time.Minute).Round(time.Second)
+	entry := func(b byte) *CacheEntry {
+		blob := make([]byte, 1000)
+		blob[0] = b
+		return &CacheEntry{
+			Blob:    blob,
+			Header:  http.Header{"Content-Type": {"image/png"}},
+			Expires: expires,
+		}
+	}
+
+	c, err := NewDiskCache(dir, 3500)
+	assert.Nil(t, err)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", entry('a'))
+	c.Set("b", entry('b'))
+	c.Set("c", entry('c'))
+	e, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, byte('a'), e.Blob[0])
+	assert.Equal(t, 1000, len(e.Blob))
+	assert.Equal(t, "image/png", e.Header.Get("Content-Type"))
+	assert.True(t, expires.Equal(e.Expires))
+
+	// Adding "d" should evict "b", the least recently used.
+	c.Set("d", entry('d'))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"c", "d", "a"} {
+		_, ok = c.Get(key)
+		assert.True(t, ok, key)
+	}
+
+	// Entries are sharded, and no temporary files are left behind.
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+	assert.Equal(t, 3, len(files))
+	stats := c.Stats()
+	assert.Equal(t, 3, stats.Entries)
+
+	// Expired entries are never returned, and are removed from disk.
+	c.Set("e", &CacheEntry{Blob: make([]byte, 10), Expires: time.Now().Add(-time.Second)})
+	_, ok = c.Get("e")
+	assert.False(t, ok)
+	_, err = os.Stat(c.path(diskCacheName("e")))
+	assert.True(t, os.IsNotExist(err))
+
+	// Entries survive a restart, but leftovers from interrupted writes don't.
+	temp := filepath.Join(dir, diskCacheTempPrefix+"junk")
+	assert.Nil(t, ioutil.WriteFile(temp, []byte("junk"), 0644))
+	c, err = NewDiskCache(dir, 3500)
+	assert.Nil(t, err)
+	stats = c.Stats()
+	assert.Equal(t, 3, stats.Entries)
+	assert.Equal(t, int64(0), stats.Hits)
+	e, ok = c.Get("d")
+	assert.True(t, ok)
+	assert.Equal(t, byte('d'), e.Blob[0])
+	_, err = os.Stat(temp)
+	assert.True(t, os.IsNotExist(err))
+
+	// Shrinking the cache evicts the least recently used entries on startup.
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(c.path(diskCacheName("a")), old, old))
+	c, err = NewDiskCache(dir, 2500)
+	assert.Nil(t, err)
+	stats = c.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.True(t, stats.Bytes <= 2500)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	_, ok = c.Get("d")
+	assert.True(t, ok)
+}
+
+func TestTieredCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fotomat-cache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	memory := NewMemoryCache(1 << 20)
+	disk, err := NewDiskCache(dir, 1<<20)
+	assert.Nil(t, err)
+	c := TieredCache{memory, disk}
+
+	entry := &CacheEntry{Blob: []byte("thumbnail"), Expires: time.Now().Add(time.Minute)}
+	disk.Set("a", entry)
+
+	// A disk hit should be copied into memory.
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+	_, ok = memory.Get("a")
+	assert.True(t, ok)
+
+	c.Set("b", entry)
+	_, ok = memory.Get("b")
+	assert.True(t, ok)
+	_, ok = disk.Get("b")
+	assert.True(t, ok)
+}
@@ -0,0 +1,74 @@
+package thumbnail
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces concurrent calls with the same key, so that only
+// one does the work and the rest share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+	// running counts calls of fn that haven't returned, including those
+	// every caller has given up on.
+	running int32
+}
+
+type flightCall struct {
+	done    chan struct{}
+	aborted chan bool
+	waiters int
+	result  *proxyResult
+}
+
+// do calls fn, unless a call with the same key is already in flight, and
+// returns its result. If aborted is closed first, do returns nil without
+// waiting. fn's own aborted channel is only closed once every caller
+// waiting on it has given up.
+func (g *flightGroup) do(key string, aborted <-chan bool, fn func(aborted <-chan bool) *proxyResult) *proxyResult {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		c = &flightCall{done: make(chan struct{}), aborted: make(chan bool)}
+		g.calls[key] = c
+		atomic.AddInt32(&g.running, 1)
+		go g.call(key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.result
+	case <-aborted:
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c.waiters--
+	if c.waiters == 0 && g.calls[key] == c {
+		// Nobody is left to use the result. Later callers start afresh.
+		delete(g.calls, key)
+		close(c.aborted)
+	}
+
+	return nil
+}
+
+func (g *flightGroup) call(key string, c *flightCall, fn func(aborted <-chan bool) *proxyResult) {
+	c.result = fn(c.aborted)
+
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+
+	close(c.done)
+	atomic.AddInt32(&g.running, -1)
+}
@@ -0,0 +1,77 @@
+package thumbnail
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls int32
+
+	release := make(chan bool)
+	fn := func(aborted <-chan bool) *proxyResult {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-release:
+			return &proxyResult{status: 200}
+		case <-aborted:
+			return &proxyResult{err: ErrAborted}
+		}
+	}
+
+	// Concurrent calls with the same key share one call of fn.
+	var wg sync.WaitGroup
+	results := make([]*proxyResult, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = g.do("a", nil, fn)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, r := range results {
+		assert.Equal(t, 200, r.status)
+	}
+
+	// One caller aborting doesn't abort the others.
+	release = make(chan bool)
+	aborted := make(chan bool)
+	done := make(chan *proxyResult)
+	go func() { done <- g.do("b", aborted, fn) }()
+	go func() { done <- g.do("b", nil, fn) }()
+	time.Sleep(50 * time.Millisecond)
+	close(aborted)
+	assert.Nil(t, <-done)
+	close(release)
+	r := <-done
+	assert.Equal(t, 200, r.status)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// Work is aborted once every caller has aborted.
+	aborted = make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		g.do("c", aborted, func(aborted <-chan bool) *proxyResult {
+			<-aborted
+			close(stopped)
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(aborted)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Work wasn't aborted")
+	}
+}
@@ -0,0 +1,188 @@
+package thumbnail
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrLoopbackAddress is returned when an upstream resolves to this
+	// machine.
+	ErrLoopbackAddress = errors.New("Upstream resolves to a loopback address")
+	// ErrLinkLocalAddress is returned when an upstream resolves to a
+	// link-local address.
+	ErrLinkLocalAddress = errors.New("Upstream resolves to a link-local address")
+	// ErrPrivateAddress is returned when an upstream resolves to a
+	// private, multicast, or otherwise reserved address.
+	ErrPrivateAddress = errors.New("Upstream resolves to a private address")
+	// ErrMetadataAddress is returned when an upstream resolves to a cloud
+	// provider's instance metadata service.
+	ErrMetadataAddress = errors.New("Upstream resolves to a metadata service address")
+)
+
+// blockedNetworks are refused by AddressGuard, checked in order.
+var blockedNetworks = []struct {
+	network *net.IPNet
+	err     error
+}{
+	{mustParseCIDR("169.254.169.254/32"), ErrMetadataAddress}, // AWS, GCP, Azure, etc.
+	{mustParseCIDR("100.100.100.200/32"), ErrMetadataAddress}, // Alibaba
+	{mustParseCIDR("fd00:ec2::254/128"), ErrMetadataAddress},  // AWS IPv6
+	{mustParseCIDR("0.0.0.0/8"), ErrLoopbackAddress},          // Reaches localhost on Linux.
+	{mustParseCIDR("127.0.0.0/8"), ErrLoopbackAddress},
+	{mustParseCIDR("::/128"), ErrLoopbackAddress},
+	{mustParseCIDR("::1/128"), ErrLoopbackAddress},
+	{mustParseCIDR("169.254.0.0/16"), ErrLinkLocalAddress},
+	{mustParseCIDR("fe80::/10"), ErrLinkLocalAddress},
+	{mustParseCIDR("10.0.0.0/8"), ErrPrivateAddress},
+	{mustParseCIDR("100.64.0.0/10"), ErrPrivateAddress}, // Carrier-grade NAT
+	{mustParseCIDR("172.16.0.0/12"), ErrPrivateAddress},
+	{mustParseCIDR("192.0.0.0/24"), ErrPrivateAddress},
+	{mustParseCIDR("192.168.0.0/16"), ErrPrivateAddress},
+	{mustParseCIDR("198.18.0.0/15"), ErrPrivateAddress},
+	{mustParseCIDR("224.0.0.0/3"), ErrPrivateAddress}, // Multicast and reserved
+	{mustParseCIDR("fc00::/7"), ErrPrivateAddress},
+	{mustParseCIDR("ff00::/8"), ErrPrivateAddress},
+}
+
+var (
+	// nat64Network and sixToFourNetwork reach the IPv4 address in
+	// their last and second through fifth bytes.
+	nat64Network     = mustParseCIDR("64:ff9b::/96")
+	sixToFourNetwork = mustParseCIDR("2002::/16")
+)
+
+// AddressGuard is a Dial function for http.Transport that refuses to
+// connect to loopback, link-local, private, and metadata service
+// addresses, so that requests can't make a Proxy fetch from internal
+// services.  Hostnames are resolved and checked before connecting to the
+// checked address.  If an http.Transport uses a proxy, only the proxy's
+// address is checked.
+type AddressGuard struct {
+	// Allow lists networks that may be connected to even if they would
+	// otherwise be refused.
+	Allow []*net.IPNet
+	// Dialer makes allowed connections.
+	Dialer *net.Dialer
+}
+
+// NewAddressGuard creates an AddressGuard that allows networks in allow,
+// and times out connection attempts after timeout (0=disable).
+func NewAddressGuard(allow []*net.IPNet, timeout time.Duration) *AddressGuard {
+	return &AddressGuard{Allow: allow, Dialer: &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}}
+}
+
+// Check returns an error describing why ip may not be connected to, or
+// nil if it may.
+func (g *AddressGuard) Check(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, n := range g.Allow {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+
+	// NAT64 and 6to4 addresses reach the IPv4 address they embed.
+	if ip4 := embeddedIPv4(ip); ip4 != nil {
+		return g.Check(ip4)
+	}
+
+	for _, b := range blockedNetworks {
+		if b.network.Contains(ip) {
+			return b.err
+		}
+	}
+
+	return nil
+}
+
+// embeddedIPv4 returns the IPv4 address that a NAT64 or 6to4 address
+// embeds, or nil.
+func embeddedIPv4(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len {
+		return nil
+	}
+
+	switch {
+	case nat64Network.Contains(ip):
+		return ip[12:16]
+	case sixToFourNetwork.Contains(ip):
+		return ip[2:6]
+	}
+	return nil
+}
+
+// Dial connects to the first address of addr that Check allows.  If none
+// are allowed, it returns the reason the first was refused.  Use
+// DialContext instead where it's available.
+func (g *AddressGuard) Dial(network, addr string) (net.Conn, error) {
+	return g.dial(network, addr, net.LookupIP, g.Dialer.Dial)
+}
+
+// dial resolves addr with lookup and connects to the first allowed address
+// with connect.
+func (g *AddressGuard) dial(network, addr string, lookup func(host string) ([]net.IP, error), connect func(network, address string) (net.Conn, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = lookup(host); err != nil {
+			return nil, err
+		}
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		err := g.Check(ip)
+		if err == nil {
+			var conn net.Conn
+			if conn, err = connect(network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = &net.AddrError{Err: "no addresses", Addr: host}
+	}
+	return nil, firstErr
+}
+
+// isBlockedAddress returns the AddressGuard error err wraps, or nil.
+func isBlockedAddress(err error) error {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+			continue
+		case *net.OpError:
+			err = e.Err
+			continue
+		}
+
+		switch err {
+		case ErrLoopbackAddress, ErrLinkLocalAddress, ErrPrivateAddress, ErrMetadataAddress:
+			return err
+		}
+		return nil
+	}
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
@@ -0,0 +1,20 @@
+// +build go1.7
+
+package thumbnail
+
+import (
+	"context"
+	"net"
+)
+
+// DialContext is Dial, for http.Transport's DialContext, aborting the
+// lookup and connection attempt if ctx is canceled.
+func (g *AddressGuard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	lookup := func(host string) ([]net.IP, error) {
+		return lookupIP(ctx, host)
+	}
+	connect := func(network, address string) (net.Conn, error) {
+		return g.Dialer.DialContext(ctx, network, address)
+	}
+	return g.dial(network, addr, lookup, connect)
+}
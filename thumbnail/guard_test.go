@@ -0,0 +1,84 @@
+package thumbnail
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressGuardCheck(t *testing.T) {
+	g := NewAddressGuard(nil, 0)
+	for ip, err := range map[string]error{
+		"8.8.8.8":              nil,
+		"2001:4860:4860::8888": nil,
+		"127.0.0.1":            ErrLoopbackAddress,
+		"127.255.0.1":          ErrLoopbackAddress,
+		"0.0.0.0":              ErrLoopbackAddress,
+		"::1":                  ErrLoopbackAddress,
+		"::":                   ErrLoopbackAddress,
+		"::ffff:127.0.0.1":     ErrLoopbackAddress,
+		"169.254.1.1":          ErrLinkLocalAddress,
+		"fe80::1":              ErrLinkLocalAddress,
+		"169.254.169.254":      ErrMetadataAddress,
+		"fd00:ec2::254":        ErrMetadataAddress,
+		"100.100.100.200":      ErrMetadataAddress,
+		"10.1.2.3":             ErrPrivateAddress,
+		"172.16.0.1":           ErrPrivateAddress,
+		"172.32.0.1":           nil,
+		"192.168.1.1":          ErrPrivateAddress,
+		"100.64.0.1":           ErrPrivateAddress,
+		"fd12:3456::1":         ErrPrivateAddress,
+		"224.0.0.1":            ErrPrivateAddress,
+		"255.255.255.255":      ErrPrivateAddress,
+		"64:ff9b::8.8.8.8":     nil,
+		"64:ff9b::127.0.0.1":   ErrLoopbackAddress,
+		"64:ff9b::a9fe:a9fe":   ErrMetadataAddress,
+		"2002:0808:0808::1":    nil,
+		"2002:0a01:0203::1":    ErrPrivateAddress,
+		"2002:7f00:0001::1":    ErrLoopbackAddress,
+	} {
+		assert.Equal(t, err, g.Check(net.ParseIP(ip)), ip)
+	}
+
+	// Allowed networks take precedence.
+	_, ten, _ := net.ParseCIDR("10.1.0.0/16")
+	g.Allow = []*net.IPNet{ten}
+	assert.Nil(t, g.Check(net.ParseIP("10.1.2.3")))
+	assert.Equal(t, ErrPrivateAddress, g.Check(net.ParseIP("10.2.2.3")))
+	assert.Nil(t, g.Check(net.ParseIP("64:ff9b::10.1.2.3")))
+}
+
+func TestAddressGuardDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	g := NewAddressGuard(nil, 0)
+	_, err = g.Dial("tcp", l.Addr().String())
+	assert.Equal(t, ErrLoopbackAddress, err)
+	_, err = g.Dial("tcp", "localhost:"+port)
+	assert.Equal(t, ErrLoopbackAddress, err)
+	_, err = g.Dial("tcp", "localhost")
+	assert.NotNil(t, err)
+
+	_, local, _ := net.ParseCIDR("127.0.0.1/32")
+	g.Allow = []*net.IPNet{local}
+	conn, err := g.Dial("tcp", l.Addr().String())
+	if assert.Nil(t, err) {
+		conn.Close()
+	}
+}
+
+func TestIsBlockedAddress(t *testing.T) {
+	wrapped := &url.Error{Op: "Get", URL: "http://internal/", Err: &net.OpError{Op: "dial", Err: ErrPrivateAddress}}
+	assert.Equal(t, ErrPrivateAddress, isBlockedAddress(wrapped))
+	assert.Equal(t, ErrMetadataAddress, isBlockedAddress(ErrMetadataAddress))
+	assert.Nil(t, isBlockedAddress(&url.Error{Op: "Get", URL: "http://internal/", Err: errors.New("Other")}))
+	assert.Nil(t, isBlockedAddress(nil))
+}
@@ -0,0 +1,29 @@
+// +build go1.7,!go1.8
+
+package thumbnail
+
+import (
+	"context"
+	"net"
+)
+
+// lookupIP resolves host, returning early if ctx is canceled.  Go 1.7 has
+// no way to cancel the lookup itself, so it finishes in the background.
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ips, err := net.LookupIP(host)
+		done <- result{ips, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.ips, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
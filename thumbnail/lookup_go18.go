@@ -0,0 +1,22 @@
+// +build go1.8
+
+package thumbnail
+
+import (
+	"context"
+	"net"
+)
+
+// lookupIP resolves host, aborting if ctx is canceled.
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
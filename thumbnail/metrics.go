@@ -0,0 +1,84 @@
+package thumbnail
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/metrics"
+)
+
+var (
+	requestsTotal   = metrics.NewCounterVec("fotomat_requests_total", "Requests served, by HTTP status.", "status")
+	requestDuration = metrics.NewHistogram("fotomat_request_duration_seconds", "Time to serve a request.", metrics.DefaultBuckets)
+
+	fetchDuration = metrics.NewHistogram("fotomat_upstream_fetch_duration_seconds", "Time to fetch an original image from upstream.", metrics.DefaultBuckets)
+	fetchBytes    = metrics.NewHistogram("fotomat_upstream_fetch_bytes", "Size of responses fetched from upstream.", metrics.SizeBuckets)
+
+	queueWait   = metrics.NewHistogram("fotomat_queue_wait_seconds", "Time spent waiting for a Proxy fetch slot.", metrics.DefaultBuckets)
+	activeSlots = metrics.NewGauge("fotomat_active_slots", "Proxy fetch slots currently in use.")
+
+	poolWait       = metrics.NewHistogram("fotomat_pool_wait_seconds", "Time spent waiting for a Pool worker.", metrics.DefaultBuckets)
+	processingTime = metrics.NewHistogram("fotomat_processing_duration_seconds", "Time spent in Thumbnail by a Pool worker.", metrics.DefaultBuckets)
+
+	inputFormats  = metrics.NewCounterVec("fotomat_input_format_total", "Images processed, by input type.", "type")
+	outputFormats = metrics.NewCounterVec("fotomat_output_format_total", "Images processed, by output type.", "type")
+	inputBytes    = metrics.NewCounter("fotomat_input_bytes_total", "Bytes of images processed.")
+	outputBytes   = metrics.NewCounter("fotomat_output_bytes_total", "Bytes of thumbnails produced.")
+	savedBytes    = metrics.NewCounter("fotomat_saved_bytes_total", "Bytes saved by thumbnails smaller than their originals.")
+)
+
+// observeThumbnail records the format mix and sizes of a Thumbnail call.
+func observeThumbnail(in, out []byte, took time.Duration) {
+	processingTime.Observe(took.Seconds())
+	inputFormats.With(format.DetectFormat(in).String()).Inc()
+	inputBytes.Add(float64(len(in)))
+
+	if out == nil {
+		return
+	}
+	outputFormats.With(format.DetectFormat(out).String()).Inc()
+	outputBytes.Add(float64(len(out)))
+	if saved := len(in) - len(out); saved > 0 {
+		savedBytes.Add(float64(saved))
+	}
+}
+
+// statusWriter is an http.ResponseWriter that remembers the status sent.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// code returns the status sent, or that will be sent if nothing has been.
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// observeRequest records the outcome of a request started at start.
+func observeRequest(w *statusWriter, start time.Time) {
+	requestsTotal.With(strconv.Itoa(w.code())).Inc()
+	requestDuration.Observe(time.Since(start).Seconds())
+}
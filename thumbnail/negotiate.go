@@ -0,0 +1,131 @@
+package thumbnail
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kitwalker12/fotomat/format"
+)
+
+// negotiateFormat adjusts SaveOptions to match what a client says it can
+// accept, and returns a short name for the chosen variant, suitable for
+// distinguishing it in cache validators.  Modern formats are only used if
+// listed explicitly, since most clients send "image/*" or "*/*" regardless.
+func negotiateFormat(accept string, s format.SaveOptions) (format.SaveOptions, string) {
+	if s.Format != format.Unknown {
+		return s, ""
+	}
+
+	q := parseAccept(accept)
+
+	avif, webp := q["image/avif"], q["image/webp"]
+	s.AllowAvif = avif > 0 && avif >= webp
+	s.AllowWebp = webp > 0
+
+	// JPEG and PNG are chosen by content, unless one is refused.
+	jpeg, png := acceptQuality(q, "image/jpeg"), acceptQuality(q, "image/png")
+	forcePng := jpeg == 0 && png > 0
+	forceJpeg := png == 0 && jpeg > 0
+	if forcePng {
+		s.Lossless = true
+		s.LossyIfPhoto = false
+	} else if forceJpeg {
+		s.Lossless = false
+	}
+
+	var variant []string
+	if s.AllowAvif {
+		variant = append(variant, "avif")
+	}
+	if s.AllowWebp {
+		variant = append(variant, "webp")
+	}
+	if forcePng {
+		variant = append(variant, "png")
+	}
+	if forceJpeg {
+		variant = append(variant, "jpeg")
+	}
+
+	return s, strings.Join(variant, "+")
+}
+
+// parseAccept returns the quality of each media range in an Accept header.
+func parseAccept(accept string) map[string]float64 {
+	q := map[string]float64{}
+
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		mime := strings.ToLower(strings.TrimSpace(params[0]))
+		if mime == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					quality = v
+				}
+			}
+		}
+
+		if _, ok := q[mime]; !ok {
+			q[mime] = quality
+		}
+	}
+
+	return q
+}
+
+// acceptQuality returns the quality of mime, falling back to wildcards.
+// An empty Accept header accepts everything.
+func acceptQuality(q map[string]float64, mime string) float64 {
+	if len(q) == 0 {
+		return 1.0
+	}
+
+	for _, r := range []string{mime, "image/*", "*/*"} {
+		if v, ok := q[r]; ok {
+			return v
+		}
+	}
+
+	return 0
+}
+
+// variantEtag returns an Etag that is distinct for each variant of an
+// image generated from the same original.
+func variantEtag(etag, variant string) string {
+	if variant == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+
+	return etag[:len(etag)-1] + "-" + variant + `"`
+}
+
+// variantRequestHeader returns a copy of header suitable for passing
+// upstream, where If-None-Match refers to the original's Etag.  Etags from
+// other variants are dropped, so they never match.
+func variantRequestHeader(header http.Header, variant string) http.Header {
+	match := header.Get("If-None-Match")
+	if variant == "" || match == "" || match == "*" {
+		return header
+	}
+
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+
+	suffix := "-" + variant + `"`
+	if strings.HasSuffix(match, suffix) {
+		h.Set("If-None-Match", match[:len(match)-len(suffix)]+`"`)
+	} else {
+		h.Del("If-None-Match")
+	}
+
+	return h
+}
@@ -0,0 +1,62 @@
+package thumbnail
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kitwalker12/fotomat/format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	var negotiateTest = []struct {
+		accept  string
+		avif    bool
+		webp    bool
+		variant string
+	}{
+		{"", false, false, ""},
+		{"*/*", false, false, ""},
+		{"image/webp,image/*,*/*;q=0.8", false, true, "webp"},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", true, true, "avif+webp"},
+		{"image/avif;q=0.5,image/webp", false, true, "webp"},
+		{"image/avif,image/webp;q=0", true, false, "avif"},
+		{"image/png,image/jpeg;q=0", false, false, "png"},
+		{"image/jpeg", false, false, "jpeg"},
+	}
+	for _, n := range negotiateTest {
+		s, variant := negotiateFormat(n.accept, format.SaveOptions{Lossless: true, LossyIfPhoto: true})
+		assert.Equal(t, n.avif, s.AllowAvif, "accept: %s", n.accept)
+		assert.Equal(t, n.webp, s.AllowWebp, "accept: %s", n.accept)
+		assert.Equal(t, n.variant, variant, "accept: %s", n.accept)
+	}
+
+	// A specific Format isn't negotiable.
+	s, variant := negotiateFormat("image/webp", format.SaveOptions{Format: format.Png})
+	assert.False(t, s.AllowWebp)
+	assert.Equal(t, "", variant)
+}
+
+func TestParseAccept(t *testing.T) {
+	q := parseAccept("image/WebP;q=0.9, image/*; q = 0.5,*/*;level=1,,image/png;q=bad")
+	assert.Equal(t, map[string]float64{"image/webp": 0.9, "image/*": 0.5, "*/*": 1.0, "image/png": 1.0}, q)
+}
+
+func TestVariantEtag(t *testing.T) {
+	assert.Equal(t, `"abc-webp"`, variantEtag(`"abc"`, "webp"))
+	assert.Equal(t, `W/"abc-avif+webp"`, variantEtag(`W/"abc"`, "avif+webp"))
+	assert.Equal(t, `"abc"`, variantEtag(`"abc"`, ""))
+
+	// Strip the variant from If-None-Match for the upstream request.
+	h := variantRequestHeader(http.Header{"If-None-Match": {`"abc-webp"`}}, "webp")
+	assert.Equal(t, `"abc"`, h.Get("If-None-Match"))
+
+	// Drop If-None-Match from other variants.
+	h = variantRequestHeader(http.Header{"If-None-Match": {`"abc-avif+webp"`}}, "webp")
+	assert.Equal(t, "", h.Get("If-None-Match"))
+
+	// Leave everything else alone.
+	h = variantRequestHeader(http.Header{"If-None-Match": {"*"}, "Cache-Control": {"no-cache"}}, "webp")
+	assert.Equal(t, "*", h.Get("If-None-Match"))
+	assert.Equal(t, "no-cache", h.Get("Cache-Control"))
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"image/color"
 	"time"
 
 	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/vips"
 )
 
 var (
@@ -16,6 +18,8 @@ var (
 	ErrTooBig = errors.New("Image is too wide or tall")
 	// ErrTooSmall is returned when an image is too small.
 	ErrTooSmall = errors.New("Image is too small")
+	// ErrTooManyFrames is returned when an animated image has too many frames.
+	ErrTooManyFrames = errors.New("Image has too many frames")
 )
 
 const (
@@ -23,6 +27,34 @@ const (
 	maxDimension = (1 << 15) - 2 // Avoid signed int16 overflows.
 )
 
+// Gravity specifies which part of an image is kept when cropping.
+type Gravity int
+
+// Gravity values understood by Options.
+const (
+	// GravityDefault centers horizontally and keeps more of the top of
+	// the image, where faces tend to be.
+	GravityDefault Gravity = iota
+	GravityCenter
+	GravityNorth
+	GravitySouth
+	GravityEast
+	GravityWest
+	// GravityEntropy keeps the area with the most detail.  Requires
+	// VIPS 8.5; Check returns ErrBadOption otherwise.  Images that stay
+	// animated use GravityCenter instead, so every frame gets the same
+	// crop.
+	GravityEntropy
+	// GravityAttention keeps the area most likely to draw the eye,
+	// based on skin tones, saturated colors, and edges.  Requires VIPS
+	// 8.5; Check returns ErrBadOption otherwise.  Images that stay
+	// animated use GravityCenter instead, as with GravityEntropy.
+	GravityAttention
+	// GravityFocus keeps the area closest to FocusX, FocusY.
+	GravityFocus
+	gravityLimit
+)
+
 // Options specifies how a Thumbnail operation should modify an image.
 type Options struct {
 	// Width and Height are the optional maximum sizes of output image,
@@ -33,9 +65,34 @@ type Options struct {
 	// Crop enables crop mode, where exact supplied Width:Height aspect
 	// ratio is preserved and excess pixels are trimmed from the sides.
 	Crop bool
+	// Pad enables pad mode, where the image is scaled to fit within
+	// Width and Height and then placed on a canvas of exactly that size.
+	Pad bool
+	// Background is the color of the canvas in pad mode, or nil for
+	// opaque white.  Alpha below 255 gives a transparent canvas, which
+	// requires PNG or WebP.
+	Background *color.NRGBA
+	// Gravity selects which part of the image is kept in crop mode, or
+	// where on the canvas the image is placed in pad mode.
+	Gravity Gravity
+	// FocusX and FocusY are the fractions of the way across and down the
+	// image to center the crop on with GravityFocus (0.0-1.0).
+	FocusX float64
+	FocusY float64
+	// Enlarge allows scaling images up to reach Width and Height, which
+	// otherwise only ever shrink.
+	Enlarge bool
+	// MaxEnlarge, if nonzero, limits how many times larger than the
+	// original an enlarged image may be (1.0 or more).
+	MaxEnlarge float64
 	// MaxBufferPixels specifies how large of an intermediate image
 	// buffer to allow, in pixels. RAM usage will be a few bytes per pixel.
 	MaxBufferPixels int
+	// MaxFrames limits how many frames an animated image can have.
+	MaxFrames int
+	// MaxTotalPixels limits the number of pixels in all frames of an
+	// animated image combined.
+	MaxTotalPixels int
 	// Sharpen runs a mild sharpening pass on downsampled images.
 	Sharpen bool
 	// BlurSigma performs a gaussian blur with specified sigma.
@@ -53,7 +110,8 @@ type Options struct {
 }
 
 // Check verifies Options against Metadata and returns a modified
-// Options or an error.
+// Options or an error.  m may come from format.MetadataHeader, to refuse
+// images before they are decoded.
 func (o Options) Check(m format.Metadata) (Options, error) {
 	// Input format must be set.
 	if m.Format == format.Unknown {
@@ -82,10 +140,14 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 	if o.Width > maxDimension || o.Height > maxDimension {
 		return Options{}, ErrTooBig
 	}
-	// If requested crop width or height are larger than original, scale
-	// request down to fit within original dimensions.
-	if o.Crop && (o.Width > m.Width || o.Height > m.Height) {
-		o.Width, o.Height, _ = scaleAspect(o.Width, o.Height, m.Width, m.Height, true)
+	if o.MaxEnlarge != 0.0 && (o.MaxEnlarge < 1.0 || o.MaxEnlarge > maxDimension) {
+		return Options{}, ErrBadOption
+	}
+	// If requested crop width or height are larger than original (or
+	// the most we're allowed to enlarge it to), scale request down to
+	// fit within those dimensions.
+	if lw, lh := o.scaleLimit(m); o.Crop && (o.Width > lw || o.Height > lh) {
+		o.Width, o.Height, _ = scaleAspect(o.Width, o.Height, lw, lh, true)
 	}
 
 	// If set, limit allocated pixels to MaxBufferPixels.  Assume JPEG
@@ -98,13 +160,84 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 		return Options{}, ErrTooBig
 	}
 
+	// Security: Animated images hold every frame in RAM at once.
+	if o.MaxFrames > 0 && m.Frames > o.MaxFrames {
+		return Options{}, ErrTooManyFrames
+	}
+	if o.MaxTotalPixels > 0 && m.Frames > 1 && m.Width*m.Height*m.Frames > o.MaxTotalPixels {
+		return Options{}, ErrTooBig
+	}
+
+	// Security: An enlarged image can be larger than the original, so
+	// verify its size too.
+	if o.Enlarge {
+		iw, ih, _ := o.scaledSize(m)
+		if iw > maxDimension || ih > maxDimension {
+			return Options{}, ErrTooBig
+		}
+		if o.MaxBufferPixels > 0 && iw*ih > o.MaxBufferPixels {
+			return Options{}, ErrTooBig
+		}
+	}
+
+	if o.Crop && o.Pad {
+		return Options{}, ErrBadOption
+	}
+
+	// Security: The pad canvas is allocated at its full size too.
+	if o.Pad && o.MaxBufferPixels > 0 && o.Width*o.Height > o.MaxBufferPixels {
+		return Options{}, ErrTooBig
+	}
+
 	if o.BlurSigma < 0.0 || o.BlurSigma > 8.0 {
 		return Options{}, ErrBadOption
 	}
 
+	if o.Gravity < GravityDefault || o.Gravity >= gravityLimit {
+		return Options{}, ErrBadOption
+	}
+	if (o.Gravity == GravityEntropy || o.Gravity == GravityAttention) && !vips.SmartcropSupported {
+		return Options{}, ErrBadOption
+	}
+
+	if o.FocusX < 0.0 || o.FocusX > 1.0 || o.FocusY < 0.0 || o.FocusY > 1.0 {
+		return Options{}, ErrBadOption
+	}
+
 	return o, nil
 }
 
+// scaleLimit returns the largest width and height that the original image
+// described by m may be scaled to.
+func (o Options) scaleLimit(m format.Metadata) (int, int) {
+	if !o.Enlarge {
+		return m.Width, m.Height
+	}
+	if o.MaxEnlarge > 0.0 {
+		return int(float64(m.Width) * o.MaxEnlarge), int(float64(m.Height) * o.MaxEnlarge)
+	}
+	return maxDimension, maxDimension
+}
+
+// scaledSize returns the size the original image described by m is scaled
+// to before cropping or padding, and whether the width is exact.  For crop,
+// this is the intermediate size the original image would have to be
+// scaled to be cropped to requested size.
+func (o Options) scaledSize(m format.Metadata) (int, int, bool) {
+	w, h := o.Width, o.Height
+	if !o.Crop {
+		lw, lh := o.scaleLimit(m)
+		if w > lw {
+			w = lw
+		}
+		if h > lh {
+			h = lh
+		}
+	}
+
+	return scaleAspect(m.Width, m.Height, w, h, !o.Crop)
+}
+
 // ToJSON returns a compact JSON representation of Options.
 func (o Options) ToJSON() ([]byte, error) {
 	j, err := json.Marshal(o)
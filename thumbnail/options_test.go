@@ -41,6 +41,24 @@ func TestOptionsValidation(t *testing.T) {
 
 	_, err = Options{Height: 32767}.Check(m)
 	assert.Equal(t, err, ErrTooBig)
+
+	_, err = Options{Crop: true, Pad: true}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Enlarge: true, MaxEnlarge: 0.5}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Gravity: -1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Gravity: gravityLimit}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Gravity: GravityFocus, FocusX: 1.5}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Gravity: GravityFocus, FocusY: -0.5}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
 }
 
 func TestOptionsCrop(t *testing.T) {
@@ -58,3 +76,51 @@ func TestOptionsCrop(t *testing.T) {
 	assert.Equal(t, r.Width, 400)
 	assert.Equal(t, r.Height, 800)
 }
+
+func TestOptionsEnlarge(t *testing.T) {
+	m := format.Metadata{Width: 64, Height: 48, Format: format.Png}
+
+	// Without Enlarge, crops are limited to the original size.
+	r, err := Options{Width: 256, Height: 256, Crop: true}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 48)
+	assert.Equal(t, r.Height, 48)
+
+	// With Enlarge, they aren't.
+	r, err = Options{Width: 256, Height: 256, Crop: true, Enlarge: true}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 256)
+	assert.Equal(t, r.Height, 256)
+
+	// Unless MaxEnlarge says otherwise.
+	r, err = Options{Width: 256, Height: 256, Crop: true, Enlarge: true, MaxEnlarge: 2}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 96)
+	assert.Equal(t, r.Height, 96)
+
+	// Enlarged images still have to fit in MaxBufferPixels.
+	_, err = Options{Width: 2048, Height: 2048, Enlarge: true, MaxBufferPixels: 1000000}.Check(m)
+	assert.Equal(t, err, ErrTooBig)
+
+	// Nor can pad canvases, even without Enlarge.
+	_, err = Options{Width: 2048, Height: 2048, Pad: true, MaxBufferPixels: 1000000}.Check(m)
+	assert.Equal(t, err, ErrTooBig)
+
+	// And can't be scaled to more than maxDimension to be cropped.
+	m = format.Metadata{Width: 4000, Height: 10, Format: format.Png}
+	_, err = Options{Width: 100, Height: 100, Crop: true, Enlarge: true}.Check(m)
+	assert.Equal(t, err, ErrTooBig)
+}
+
+func TestOptionsFrames(t *testing.T) {
+	m := format.Metadata{Width: 100, Height: 100, Format: format.Gif, Frames: 10}
+
+	_, err := Options{MaxFrames: 10, MaxTotalPixels: 100000}.Check(m)
+	assert.Equal(t, err, nil)
+
+	_, err = Options{MaxFrames: 9}.Check(m)
+	assert.Equal(t, err, ErrTooManyFrames)
+
+	_, err = Options{MaxTotalPixels: 99999}.Check(m)
+	assert.Equal(t, err, ErrTooBig)
+}
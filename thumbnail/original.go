@@ -0,0 +1,106 @@
+package thumbnail
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kitwalker12/fotomat/trace"
+)
+
+// originalStaleRetention is how long a stale original with a validator is
+// kept for revalidation.
+const originalStaleRetention = 24 * time.Hour
+
+// fetchOriginal is get, but uses OriginalCache if set. A fresh cached
+// original is returned without contacting upstream, and a stale one is
+// revalidated using its Etag or Last-Modified.
+func (p *Proxy) fetchOriginal(url string, header http.Header, span *trace.Span) ([]byte, http.Header, int, error) {
+	if p.OriginalCache == nil {
+		return p.get(url, header, span)
+	}
+
+	now := time.Now()
+	e, ok := p.OriginalCache.Get(url)
+	if !ok {
+		orig, upstream, status, err := p.get(url, header, span)
+		if err == nil && status == http.StatusOK {
+			p.storeOriginal(url, orig, upstream, now)
+		}
+		return orig, upstream, status, err
+	}
+
+	if isFresh(e, now) && !strings.Contains(header.Get("Cache-Control"), "no-cache") {
+		// Account for the time it has spent in our cache.
+		h := http.Header{}
+		for k, v := range e.Header {
+			h[k] = v
+		}
+		age, _ := strconv.Atoi(e.Header.Get("Age"))
+		h.Set("Age", strconv.Itoa(age+int(now.Sub(e.Date)/time.Second)))
+		span.SetAttribute("cache_hit", true)
+		return e.Blob, h, http.StatusOK, nil
+	}
+
+	// Ask upstream whether our copy is still good, rather than passing on
+	// the client's validators.
+	h := http.Header{}
+	copyHeaders(header, h, []string{"Cache-Control"})
+	if etag := e.Header.Get("Etag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lastMod := e.Header.Get("Last-Modified"); lastMod != "" {
+		h.Set("If-Modified-Since", lastMod)
+	}
+
+	orig, upstream, status, err := p.get(url, h, span)
+	switch {
+	case err != nil:
+		return nil, nil, 0, err
+	case status == http.StatusNotModified:
+		// Same image, with possibly updated freshness.
+		updated := http.Header{}
+		for k, v := range e.Header {
+			updated[k] = v
+		}
+		updated.Del("Age")
+		copyHeaders(upstream, updated, []string{"Age", "Cache-Control", "Date", "Etag", "Expires", "Last-Modified"})
+		p.storeOriginal(url, e.Blob, updated, now)
+		return e.Blob, updated, http.StatusOK, nil
+	case status == http.StatusOK:
+		p.storeOriginal(url, orig, upstream, now)
+	}
+
+	return orig, upstream, status, err
+}
+
+// storeOriginal adds an original to OriginalCache, if upstream allows it
+// to be reused without a full download for some time.
+func (p *Proxy) storeOriginal(url string, orig []byte, upstream http.Header, now time.Time) {
+	cc := cacheControl(upstream)
+	if _, ok := cc["no-store"]; ok {
+		return
+	}
+	if _, ok := cc["private"]; ok {
+		return
+	}
+
+	expires := now.Add(cacheLifetime(upstream, now))
+	if upstream.Get("Etag") != "" || upstream.Get("Last-Modified") != "" {
+		if expires.Before(now) {
+			expires = now
+		}
+		expires = expires.Add(originalStaleRetention)
+	} else if !expires.After(now) {
+		return
+	}
+
+	p.OriginalCache.Set(url, &CacheEntry{Blob: orig, Header: upstream, Date: now, Expires: expires})
+}
+
+// isFresh returns whether a cached original may be used without
+// revalidating it.
+func isFresh(e *CacheEntry, now time.Time) bool {
+	return now.Before(e.Date.Add(cacheLifetime(e.Header, e.Date)))
+}
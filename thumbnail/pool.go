@@ -4,7 +4,10 @@ import (
 	"errors"
 	"runtime"
 	"sync"
+	"time"
 
+	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/trace"
 	"github.com/kitwalker12/fotomat/vips"
 )
 
@@ -12,6 +15,9 @@ var (
 	// ErrAborted means the operation wasn't executed because the
 	// Request.Aborted channel was closed by the caller.
 	ErrAborted = errors.New("Thumbnail request aborted")
+	// ErrPoolClosed means the operation wasn't executed because the Pool
+	// has been closed.
+	ErrPoolClosed = errors.New("Thumbnail pool closed")
 )
 
 // Pool represents a Thumbnail worker pool. VIPS keeps thread-local caches,
@@ -20,6 +26,8 @@ var (
 type Pool struct {
 	RequestCh chan *Request
 	wg        sync.WaitGroup
+	mu        sync.RWMutex
+	closed    bool
 }
 
 // NewPool creates a Thumbnail worker pool with a given number of worker
@@ -46,27 +54,51 @@ type Request struct {
 	Options    Options
 	Aborted    <-chan bool
 	ResponseCh chan<- *Response
+
+	queued time.Time
+	span   *trace.Span
+	wait   *trace.Span
 }
 
 // Response sent to Request.ResponseCh when the Thumbnail operation is done.
 type Response struct {
 	Blob  []byte
 	Error error
+
+	wait       time.Duration
+	processing time.Duration
+	input      format.Metadata
 }
 
 // Thumbnail is a blocking wrapper that executes thumbnail.Thumbnail
 // requests in a pool of worker threads.  Work is skipped if aborted is
 // closed while the request is queued.
 func (p *Pool) Thumbnail(blob []byte, options Options, aborted <-chan bool) ([]byte, error) {
+	s := p.thumbnail(blob, options, aborted, nil)
+	return s.Blob, s.Error
+}
+
+// thumbnail is Thumbnail, but returns the whole Response, including how
+// long the request waited for a worker and was processed for and the
+// original's Metadata, and traces those stages as children of span.
+func (p *Pool) thumbnail(blob []byte, options Options, aborted <-chan bool, span *trace.Span) *Response {
+	// Hold mu so that Close can't close RequestCh while we send.
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return &Response{Error: ErrPoolClosed}
+	}
+
 	rc := make(chan *Response)
 
-	r := &Request{Blob: blob, Options: options, Aborted: aborted, ResponseCh: rc}
+	r := &Request{Blob: blob, Options: options, Aborted: aborted, ResponseCh: rc, queued: time.Now(), span: span, wait: span.Child("pool_wait")}
 	p.RequestCh <- r
+	p.mu.RUnlock()
 
 	s := <-rc
 	close(rc)
 
-	return s.Blob, s.Error
+	return s
 }
 
 func (p *Pool) worker() {
@@ -78,11 +110,20 @@ func (p *Pool) worker() {
 			break
 		}
 
+		q.wait.End()
+
 		s := &Response{}
 		if hasAborted(q.Aborted) {
 			s.Error = ErrAborted
 		} else {
-			s.Blob, s.Error = Thumbnail(q.Blob, q.Options)
+			start := time.Now()
+			if !q.queued.IsZero() {
+				s.wait = start.Sub(q.queued)
+				poolWait.Observe(s.wait.Seconds())
+			}
+			s.Blob, s.Error = thumbnail(q.Blob, q.Options, q.span, &s.input)
+			s.processing = time.Since(start)
+			observeThumbnail(q.Blob, s.Blob, s.processing)
 		}
 
 		q.ResponseCh <- s
@@ -95,8 +136,12 @@ func (p *Pool) worker() {
 }
 
 // Close shuts down the worker pool and waits for remaining work to be done.
+// Thumbnail returns ErrPoolClosed afterward.
 func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
 	close(p.RequestCh)
+	p.mu.Unlock()
 	p.wg.Wait()
 }
 
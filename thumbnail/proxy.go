@@ -2,14 +2,20 @@ package thumbnail
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/trace"
 )
 
 const (
@@ -21,6 +27,9 @@ const (
 	DefaultUserAgent = "Fotomat (http://fotomat.org)"
 )
 
+// forwardHeaders are passed on from client requests to upstream.
+var forwardHeaders = []string{"Cache-Control", "If-Modified-Since", "If-None-Match"}
+
 // Proxy represents an HTTP proxy that can optionally run its contents
 // through Thumbnail. Must be created with NewProxy.
 type Proxy struct {
@@ -29,8 +38,35 @@ type Proxy struct {
 	Accept    string
 	Server    string
 	UserAgent string
-	pool      *Pool
-	active    chan bool
+	// NegotiateFormat chooses WebP or AVIF output based on the
+	// client's Accept header, overriding Director's choice.
+	NegotiateFormat bool
+	// Cache, if set, stores generated thumbnails for as long as the
+	// upstream Cache-Control or Expires headers allow.
+	Cache Cache
+	// OriginalCache, if set, stores fetched original images, so that
+	// thumbnails of different sizes can share one download.  Stale
+	// originals are revalidated with If-None-Match or If-Modified-Since.
+	OriginalCache Cache
+	// MaxOriginalBytes, if nonzero, is the largest upstream image that
+	// will be downloaded.  Larger ones fail with ErrTooBig.
+	MaxOriginalBytes int64
+	// AccessLog, if set, receives a line of JSON describing each
+	// request, including how long each stage took.
+	AccessLog io.Writer
+	// AccessLogSample is the fraction of successful requests logged to
+	// AccessLog (0.0-1.0).  Failed requests are always logged.
+	AccessLogSample float64
+	// Tracer, if set, records spans for each stage of a request,
+	// continuing any trace in the request's traceparent header and
+	// passing it on upstream.
+	Tracer   *trace.Tracer
+	logMu    sync.Mutex
+	pool     *Pool
+	active   chan bool
+	flight   flightGroup
+	inflight int32
+	draining int32
 }
 
 // NewProxy creates a Proxy object, with a given Director, Pool, upper limit
@@ -41,13 +77,14 @@ func NewProxy(director func(*http.Request) (Options, int), pool *Pool, maxActive
 	}
 
 	p := &Proxy{
-		Director:  director,
-		Client:    client,
-		Accept:    DefaultAccept,
-		Server:    DefaultServer,
-		UserAgent: DefaultUserAgent,
-		pool:      pool,
-		active:    make(chan bool, maxActive),
+		Director:        director,
+		Client:          client,
+		Accept:          DefaultAccept,
+		Server:          DefaultServer,
+		UserAgent:       DefaultUserAgent,
+		AccessLogSample: 1.0,
+		pool:            pool,
+		active:          make(chan bool, maxActive),
 	}
 
 	for i := 0; i < maxActive; i++ {
@@ -60,8 +97,30 @@ func NewProxy(director func(*http.Request) (Options, int), pool *Pool, maxActive
 // ServeHTTP serves an HTTP request for a given Proxy, using Director to
 // parse the request, fetching an image, calling pool.Thumbnail on it, and
 // returning the result.
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
-	aborted := w.(http.CloseNotifier).CloseNotify()
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, or *http.Request) {
+	atomic.AddInt32(&p.inflight, 1)
+	defer atomic.AddInt32(&p.inflight, -1)
+
+	start := time.Now()
+	w := &statusWriter{ResponseWriter: rw}
+	a := &accessLogEntry{Path: or.URL.RequestURI()}
+
+	parent, _ := trace.ParseTraceparent(or.Header.Get("Traceparent"))
+	span := p.Tracer.Start("request", parent)
+	span.SetAttribute("http.method", or.Method)
+	span.SetAttribute("http.target", a.Path)
+	if c := span.Context(); c.IsValid() {
+		a.TraceID = c.TraceID.String()
+	}
+
+	defer func() {
+		observeRequest(w, start)
+		p.logAccess(a, w, or, start)
+		span.SetAttribute("http.status_code", w.code())
+		span.End()
+	}()
+
+	aborted := w.CloseNotify()
 
 	w.Header().Set("Server", p.Server)
 
@@ -70,58 +129,220 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
 		return
 	}
 
+	ds := span.Child("director")
 	options, status := p.Director(or)
+	ds.End()
 	if status != 0 {
 		http.Error(w, http.StatusText(status), status)
 		return
 	}
+	a.setOptions(options)
+
+	header := or.Header
+	variant := ""
+	if p.NegotiateFormat {
+		options.Save, variant = negotiateFormat(or.Header.Get("Accept"), options.Save)
+		header = variantRequestHeader(or.Header, variant)
+		w.Header().Set("Vary", "Accept")
+	}
+
+	key, err := cacheKey(or.URL.String(), variant, options)
+	if err != nil {
+		proxyError(w, err, 0)
+		return
+	}
+
+	if p.Cache != nil && !strings.Contains(or.Header.Get("Cache-Control"), "no-cache") {
+		if e, ok := p.Cache.Get(key); ok {
+			a.CacheHit = true
+			span.SetAttribute("cache_hit", true)
+			a.OutputFormat = format.DetectFormat(e.Blob).String()
+			a.OutputBytes = len(e.Blob)
+			serveCached(w, or, e)
+			return
+		}
+	}
+
+	// Identical concurrent requests share one fetch and one Thumbnail.
+	r := p.flight.do(flightKey(key, header), aborted, func(aborted <-chan bool) *proxyResult {
+		return p.fetchThumbnail(or.URL.String(), header, options, variant, key, aborted, span)
+	})
+	if r == nil {
+		a.Error = ErrAborted.Error()
+		span.SetError(ErrAborted)
+		proxyError(w, ErrAborted, 0)
+		return
+	}
+	a.setResult(r)
+	span.SetError(r.err)
+
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
 
+	switch {
+	case r.status == http.StatusNotModified:
+		w.WriteHeader(http.StatusNotModified)
+	case r.err != nil || r.status != http.StatusOK:
+		proxyError(w, r.err, r.status)
+	default:
+		w.Write(r.blob)
+	}
+}
+
+// proxyResult is a response shared by coalesced requests. Its header
+// must not be modified.
+type proxyResult struct {
+	blob   []byte
+	header http.Header
+	status int
+	err    error
+	stats  resultStats
+}
+
+// fetchThumbnail waits for a free slot, fetches url, and runs it through
+// Thumbnail, storing the result in Cache under key if upstream allows.
+// Stages are traced as children of span.
+func (p *Proxy) fetchThumbnail(url string, header http.Header, options Options, variant, key string, aborted <-chan bool, span *trace.Span) *proxyResult {
 	if options.MaxQueueDuration <= 0 {
 		options.MaxQueueDuration = time.Hour // "Forever" for an http request
 	}
 
 	// Wait for our turn to fetch and hold the original image.
+	var stats resultStats
+	start := time.Now()
+	qs := span.Child("queue")
+	defer qs.End()
 	select {
 	case <-aborted:
-		proxyError(w, ErrAborted, 0)
-		return
+		return &proxyResult{err: ErrAborted}
 	case <-time.After(options.MaxQueueDuration):
-		proxyError(w, nil, http.StatusGatewayTimeout)
-		return
+		return &proxyResult{status: http.StatusGatewayTimeout}
 	case <-p.active:
 	}
+	qs.End()
+	stats.queue = time.Since(start)
+	queueWait.Observe(stats.queue.Seconds())
+	activeSlots.Add(1)
+	release := func() {
+		activeSlots.Add(-1)
+		p.active <- true
+	}
 
-	orig, header, status, err := p.get(or.URL.String(), or.Header)
+	start = time.Now()
+	fs := span.Child("fetch")
+	orig, upstream, status, err := p.fetchOriginal(url, header, fs)
+	fs.SetAttribute("http.status_code", status)
+	fs.SetError(err)
+	fs.End()
+	stats.upstream = time.Since(start)
+	stats.upstreamStatus = status
 	if err != nil || (status != http.StatusOK && status != http.StatusNotModified) {
-		p.active <- true // Release semaphore ASAP.
-		proxyError(w, err, status)
-		return
+		release() // Release semaphore ASAP.
+		return &proxyResult{status: status, err: err, stats: stats}
+	}
+
+	h := http.Header{}
+	copyHeaders(upstream, h, []string{"Age", "Cache-Control", "Etag", "Expires", "Last-Modified"})
+	if etag := h.Get("Etag"); etag != "" {
+		h.Set("Etag", variantEtag(etag, variant))
 	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-XSS-Protection", "1; mode=block")
 
-	copyHeaders(header, w.Header(), []string{"Age", "Cache-Control", "Etag", "Expires", "Last-Modified"})
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-XSS-Protection", "1; mode=block")
+	if status == http.StatusNotModified || isNotModified(header, upstream) {
+		release() // Release semaphore ASAP.
+		return &proxyResult{header: h, status: http.StatusNotModified, stats: stats}
+	}
+
+	// Refuse images that are too large before waiting for a thread to
+	// decode them.
+	if m, err := format.MetadataHeader(orig); err == nil {
+		stats.input = &m
+		if _, err := options.Check(m); err != nil {
+			release() // Release semaphore ASAP.
+			return &proxyResult{err: err, stats: stats}
+		}
+	}
 
-	if status == http.StatusNotModified || isNotModified(or.Header, header) {
-		p.active <- true // Release semaphore ASAP.
+	s := p.pool.thumbnail(orig, options, aborted, span)
+	orig = nil // Free up image memory ASAP.
+	release()  // Release semaphore ASAP.
+
+	stats.poolWait, stats.processing = s.wait, s.processing
+	if stats.input == nil && s.input.Format != format.Unknown {
+		stats.input = &s.input
+	}
+	if s.Error != nil {
+		return &proxyResult{err: s.Error, stats: stats}
+	}
+
+	thumb := s.Blob
+	stats.output = format.DetectFormat(thumb)
+	h.Set("Content-Length", strconv.Itoa(len(thumb)))
+
+	if p.Cache != nil {
+		now := time.Now()
+		if lifetime := cacheLifetime(upstream, now); lifetime > 0 {
+			age, _ := strconv.Atoi(upstream.Get("Age"))
+			p.Cache.Set(key, &CacheEntry{
+				Blob:    thumb,
+				Header:  h,
+				Date:    now.Add(-time.Duration(age) * time.Second),
+				Expires: now.Add(lifetime),
+			})
+		}
+	}
+
+	return &proxyResult{blob: thumb, header: h, status: http.StatusOK, stats: stats}
+}
+
+func serveCached(w http.ResponseWriter, or *http.Request, e *CacheEntry) {
+	for k, v := range e.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.Date)/time.Second)))
+
+	if isNotModified(or.Header, e.Header) {
+		w.Header().Del("Content-Length")
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	thumb, err := p.pool.Thumbnail(orig, options, aborted)
-	orig = nil       // Free up image memory ASAP.
-	p.active <- true // Release semaphore ASAP.
+	w.Write(e.Blob)
+}
 
+// nonImageTypes are media types that are never images, even if
+// mislabeled.
+var nonImageTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/pdf":        true,
+	"application/xhtml+xml":  true,
+	"application/xml":        true,
+	"application/zip":        true,
+}
+
+// isImageType returns false if contentType obviously isn't an image.
+// Missing, generic, and unparseable types are allowed, and left to
+// format.DetectFormat.
+func isImageType(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		proxyError(w, err, 0)
-		return
+		return true
 	}
-
-	w.Header().Set("Content-Length", strconv.Itoa(len(thumb)))
-	w.Write(thumb)
+	if nonImageTypes[t] {
+		return false
+	}
+	switch t[:strings.Index(t, "/")+1] {
+	case "text/", "audio/", "video/", "font/", "multipart/":
+		return false
+	}
+	return true
 }
 
-func (p *Proxy) get(url string, header http.Header) ([]byte, http.Header, int, error) {
+// get fetches url, passing on some of header, and the trace of span.
+func (p *Proxy) get(url string, header http.Header, span *trace.Span) ([]byte, http.Header, int, error) {
 	r, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, nil, 0, err
@@ -130,24 +351,78 @@ func (p *Proxy) get(url string, header http.Header) ([]byte, http.Header, int, e
 	// Pass some headers on to upstream.
 	r.Header.Set("Accept", p.Accept)
 	r.Header.Set("User-Agent", p.UserAgent)
-	copyHeaders(header, r.Header, []string{"Cache-Control", "If-Modified-Since", "If-None-Match"})
+	copyHeaders(header, r.Header, forwardHeaders)
+	if c := span.Context(); c.IsValid() {
+		r.Header.Set("Traceparent", c.Traceparent())
+	}
 
+	start := time.Now()
 	resp, err := p.Client.Do(r)
 	if err != nil {
 		return nil, nil, 0, err
 	}
 
-	orig, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	defer resp.Body.Close()
+
+	// Give up early on responses that can't be thumbnailed, without
+	// downloading them.  A status of 0 lets proxyError report these as
+	// our own errors, rather than upstream's.
+	if resp.StatusCode == http.StatusOK && !isImageType(resp.Header.Get("Content-Type")) {
+		return nil, resp.Header, 0, format.ErrUnknownFormat
+	}
+	max := p.MaxOriginalBytes
+	if max > 0 && resp.ContentLength > max {
+		return nil, resp.Header, 0, ErrTooBig
+	}
+
+	// Content-Length may be missing or wrong, so limit what's read too.
+	var body io.Reader = resp.Body
+	if max > 0 {
+		body = io.LimitReader(resp.Body, max+1)
+	}
+	orig, err := ioutil.ReadAll(body)
+	if err == nil && max > 0 && int64(len(orig)) > max {
+		return nil, resp.Header, 0, ErrTooBig
+	}
+
+	fetchDuration.Observe(time.Since(start).Seconds())
+	fetchBytes.Observe(float64(len(orig)))
 
 	return orig, resp.Header, resp.StatusCode, err
 }
 
-// Close shuts down a Proxy.
+// Drain waits up to timeout for requests being served, and work started
+// on their behalf, to finish.  Returns false if it timed out.  Stop
+// sending new requests to the Proxy first.  Ready fails from then on.
+func (p *Proxy) Drain(timeout time.Duration) bool {
+	atomic.StoreInt32(&p.draining, 1)
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&p.inflight) > 0 || atomic.LoadInt32(&p.flight.running) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Close shuts down a Proxy, waiting for any queued Pool work to be done.
+// Must not be called while requests are being served; see Drain.
 func (p *Proxy) Close() {
+	// Leave Ready reporting that we're shutting down, as other
+	// goroutines may still call it.
+	atomic.StoreInt32(&p.draining, 1)
 	close(p.active)
 	p.pool.Close()
-	*p = Proxy{}
+}
+
+// flightKey distinguishes requests that can share an upstream fetch: the
+// same thumbnail, with the same headers passed upstream.
+func flightKey(key string, header http.Header) string {
+	for _, h := range forwardHeaders {
+		key += "\n" + strings.Join(header[h], ",")
+	}
+	return key
 }
 
 func copyHeaders(src http.Header, dest http.Header, keys []string) {
@@ -186,10 +461,15 @@ func proxyError(w http.ResponseWriter, err error, status int) {
 		switch err {
 		case format.ErrUnknownFormat, ErrTooSmall:
 			status = http.StatusUnsupportedMediaType
-		case ErrTooBig:
+		case ErrTooBig, ErrTooManyFrames:
 			status = http.StatusRequestEntityTooLarge
+		case ErrBadOption:
+			status = http.StatusBadRequest
 		default:
-			if isTimeout(err) {
+			if blocked := isBlockedAddress(err); blocked != nil {
+				err = blocked
+				status = http.StatusForbidden
+			} else if isTimeout(err) {
 				err = nil
 				status = http.StatusGatewayTimeout
 			} else {
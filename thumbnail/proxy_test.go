@@ -1,15 +1,21 @@
 package thumbnail
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/metrics"
+	"github.com/kitwalker12/fotomat/trace"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,6 +35,349 @@ func TestProxySuccess(t *testing.T) {
 	assert.Nil(t, ps.isSize("watermelon.jpg", format.Webp, 200, 100))
 }
 
+func TestProxyNegotiate(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.proxy.NegotiateFormat = true
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	// Convert to WebP only if the client asks for it.
+	ps.accept = "image/webp,image/*"
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Webp, 200, 100))
+	ps.accept = "image/*"
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+
+	// A lossless original negotiated to WebP follows the lossy policy.
+	ps.accept = "image/webp,image/*"
+	ps.options = Options{Width: 256, Height: 169}
+	lossy, _ := ps.get("flowers.png")
+	ps.options.Save = format.SaveOptions{Lossless: true, LossyWebp: true}
+	assert.Nil(t, ps.isSize("flowers.png", format.Webp, 256, 169))
+	thumb, _ := ps.get("flowers.png")
+	assert.Equal(t, len(lossy), len(thumb))
+	ps.options.Save = format.SaveOptions{Lossless: true, LossyIfPhoto: true}
+	thumb, _ = ps.get("flowers.png")
+	assert.Equal(t, len(lossy), len(thumb))
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	// Make sure shared caches know that the response depends on Accept.
+	resp, _ := ps.do("watermelon.jpg")
+	assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+}
+
+func TestProxyCache(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.proxy.Cache = NewMemoryCache(1 << 20)
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	// Don't cache unless upstream says we can.
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ps.fetches))
+
+	// Second request should be served from cache.
+	ps.cacheControl = "public, max-age=60"
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&ps.fetches))
+
+	// Different options are cached separately.
+	ps.options = Options{Width: 100, Height: 100, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 100, 100))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&ps.fetches))
+
+	stats := ps.proxy.Cache.(*MemoryCache).Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, 2, stats.Entries)
+}
+
+func TestProxyOriginalCache(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.proxy.OriginalCache = NewMemoryCache(1 << 20)
+
+	// Different sizes of a fresh original share one download.
+	ps.cacheControl = "max-age=60"
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	ps.options = Options{Width: 100, Height: 100, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 100, 100))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ps.revalidations))
+
+	// Stale originals are revalidated rather than downloaded again.
+	ps.cacheControl = "no-cache"
+	ps.options = Options{Width: 40, Height: 40, Crop: true}
+	assert.Nil(t, ps.isSize("orient1.jpg", format.Jpeg, 40, 40))
+	ps.options = Options{Width: 30, Height: 30, Crop: true}
+	assert.Nil(t, ps.isSize("orient1.jpg", format.Jpeg, 30, 30))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&ps.fetches))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.revalidations))
+}
+
+func TestProxyCoalesce(t *testing.T) {
+	ps := newProxyServer(200*time.Millisecond, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	// Identical concurrent requests should share one fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+
+	// Later requests fetch afresh.
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ps.fetches))
+}
+
+func TestProxyDrain(t *testing.T) {
+	ps := newProxyServer(300*time.Millisecond, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+	assert.True(t, ps.proxy.Drain(0))
+
+	done := make(chan error)
+	go func() { done <- ps.isSize("watermelon.jpg", format.Jpeg, 200, 100) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// Wait for the request in progress to finish.
+	assert.False(t, ps.proxy.Drain(10*time.Millisecond))
+	assert.True(t, ps.proxy.Drain(10*time.Second))
+	assert.Nil(t, <-done)
+}
+
+func TestProxyMetrics(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ok := requestsTotal.With("200").Value()
+	notFound := requestsTotal.With("404").Value()
+	jpegs := inputFormats.With("image/jpeg").Value()
+	processed := outputBytes.Value()
+
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	assert.Equal(t, http.StatusNotFound, ps.getStatus("notfound.txt"))
+
+	assert.Equal(t, ok+1, requestsTotal.With("200").Value())
+	assert.Equal(t, notFound+1, requestsTotal.With("404").Value())
+	assert.Equal(t, jpegs+1, inputFormats.With("image/jpeg").Value())
+	assert.True(t, outputBytes.Value() > processed)
+	assert.Equal(t, float64(0), activeSlots.Value())
+
+	var b bytes.Buffer
+	assert.Nil(t, metrics.Default.WriteText(&b))
+	assert.Contains(t, b.String(), `fotomat_requests_total{status="200"}`)
+	assert.Contains(t, b.String(), "fotomat_pool_wait_seconds_count")
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	lines := make(lineWriter, 10)
+	ps.proxy.AccessLog = lines
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	var a accessLogEntry
+	assert.Nil(t, json.Unmarshal(<-lines, &a))
+	assert.Equal(t, "GET", a.Method)
+	assert.Equal(t, "/watermelon.jpg", a.Path)
+	assert.Equal(t, http.StatusOK, a.Status)
+	assert.Equal(t, http.StatusOK, a.UpstreamStatus)
+	assert.Equal(t, "image/jpeg", a.InputFormat)
+	assert.Equal(t, 398, a.InputWidth)
+	assert.Equal(t, 536, a.InputHeight)
+	assert.Equal(t, "image/jpeg", a.OutputFormat)
+	assert.True(t, a.OutputBytes > 0)
+	assert.True(t, a.Processing > 0)
+	assert.Contains(t, string(a.Options), `"Width":200`)
+	assert.NotEqual(t, "", a.Client)
+
+	// Failures are logged even if successes aren't sampled.
+	ps.proxy.AccessLogSample = 0
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+	assert.Equal(t, http.StatusUnsupportedMediaType, ps.getStatus("notimage.txt"))
+	a = accessLogEntry{}
+	assert.Nil(t, json.Unmarshal(<-lines, &a))
+	assert.Equal(t, "/notimage.txt", a.Path)
+	assert.Equal(t, http.StatusUnsupportedMediaType, a.Status)
+	assert.Equal(t, format.ErrUnknownFormat.Error(), a.Error)
+	assert.Equal(t, 0, len(lines))
+}
+
+// lineWriter sends each Write to a channel.
+type lineWriter chan []byte
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestProxyTrace(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	spans := make(spanChannel, 20)
+	ps.proxy.Tracer = trace.NewTracer(spans)
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+	ps.traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 200, 100))
+
+	// Every stage is a span in the incoming trace.
+	names := map[string]*trace.SpanData{}
+	for names["request"] == nil {
+		s := <-spans
+		names[s.Name] = s
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID.String())
+	}
+	for _, name := range []string{"director", "queue", "fetch", "pool_wait", "load", "resize", "save"} {
+		if assert.NotNil(t, names[name], name) {
+			assert.Equal(t, names["request"].SpanID, names[name].ParentID, name)
+		}
+	}
+	assert.Equal(t, "00f067aa0ba902b7", names["request"].ParentID.String())
+
+	// The fetch span is passed on upstream.
+	upstream, ok := trace.ParseTraceparent(ps.upstreamTrace.Load().(string))
+	assert.True(t, ok)
+	assert.Equal(t, names["fetch"].TraceID, upstream.TraceID)
+	assert.Equal(t, names["fetch"].SpanID, upstream.SpanID)
+	assert.True(t, upstream.Sampled)
+
+	// Without a Tracer, nothing is passed upstream.
+	ps.proxy.Tracer = nil
+	ps.options = Options{Width: 100, Height: 100, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 100, 100))
+	assert.Equal(t, "", ps.upstreamTrace.Load())
+}
+
+// spanChannel is a trace.Exporter that sends each span to a channel.
+type spanChannel chan *trace.SpanData
+
+func (c spanChannel) Export(s *trace.SpanData) {
+	c <- s
+}
+
+func TestProxyReady(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	assert.Nil(t, ps.proxy.Ready(10*time.Second, 0.5))
+
+	// Fill fetch slots until more than half are busy.
+	slots := cap(ps.proxy.active)
+	for i := 0; i <= slots/2; i++ {
+		<-ps.proxy.active
+	}
+	assert.Equal(t, ErrSaturated, ps.proxy.Ready(10*time.Second, 0.5))
+	assert.Nil(t, ps.proxy.Ready(10*time.Second, 0))
+	for i := 0; i <= slots/2; i++ {
+		ps.proxy.active <- true
+	}
+
+	assert.True(t, ps.proxy.Drain(time.Second))
+	assert.Equal(t, ErrDraining, ps.proxy.Ready(10*time.Second, 0.5))
+}
+
+func TestProxyReadyAfterClose(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	pool := ps.proxy.pool
+	ps.close()
+
+	// Admin endpoints may still be answering while shutting down.
+	assert.Equal(t, ErrDraining, ps.proxy.Ready(10*time.Second, 0.5))
+	_, err := pool.Thumbnail(selfTestImage, Options{Width: 2, Height: 2}, nil)
+	assert.Equal(t, ErrPoolClosed, err)
+}
+
+func TestProxyAddressGuard(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	// The origin is on localhost, so is refused.
+	ps.proxy.Client = &http.Client{Transport: &http.Transport{Dial: NewAddressGuard(nil, 0).Dial}}
+	resp, body := ps.do("2px.png")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, string(body), ErrLoopbackAddress.Error())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ps.fetches))
+}
+
+func TestProxyMaxOriginalBytes(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.proxy.MaxOriginalBytes = 1000
+	assert.Nil(t, ps.isSize("2px.png", format.Png, 2, 3))
+
+	// Refused from Content-Length.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("watermelon.jpg"))
+
+	// Refused while reading, without Content-Length.
+	ps.chunked = true
+	_, _, status, err := ps.proxy.get(ps.origin.URL+"/watermelon.jpg", nil, nil)
+	assert.Equal(t, ErrTooBig, err)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("watermelon.jpg"))
+	assert.Nil(t, ps.isSize("2px.png", format.Png, 2, 3))
+}
+
+func TestProxyContentType(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	// Non-image types are refused before reading the body.
+	orig, _, status, err := ps.proxy.get(ps.origin.URL+"/notimage.txt", nil, nil)
+	assert.Equal(t, format.ErrUnknownFormat, err)
+	assert.Equal(t, 0, status)
+	assert.Nil(t, orig)
+
+	ps.contentType = "text/html; charset=utf-8"
+	assert.Equal(t, http.StatusUnsupportedMediaType, ps.getStatus("2px.png"))
+
+	// Generic and mislabeled image types are left to DetectFormat.
+	for _, ct := range []string{"application/octet-stream", "image/jpeg", "binary/octet-stream", "bogus"} {
+		ps.contentType = ct
+		assert.Nil(t, ps.isSize("2px.png", format.Png, 2, 3), ct)
+	}
+
+	assert.True(t, isImageType(""))
+	assert.False(t, isImageType("application/json"))
+	assert.False(t, isImageType("video/mp4"))
+}
+
+func TestProxyHeaderCheck(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	lines := make(lineWriter, 10)
+	ps.proxy.AccessLog = lines
+
+	// Refused from its header, without waiting for a VIPS thread.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("34000px.png"))
+	var a accessLogEntry
+	assert.Nil(t, json.Unmarshal(<-lines, &a))
+	assert.Equal(t, ErrTooBig.Error(), a.Error)
+	assert.Equal(t, 34000, a.InputWidth)
+	assert.Equal(t, float64(0), a.PoolWait)
+	assert.Equal(t, float64(0), a.Processing)
+}
+
 func TestProxyErrors(t *testing.T) {
 	ps := newProxyServer(0, time.Minute)
 	defer ps.close()
@@ -57,33 +406,53 @@ func TestProxyErrors(t *testing.T) {
 }
 
 type proxyServer struct {
-	proxy   *Proxy
-	server  *httptest.Server
-	origin  *httptest.Server
-	options Options
-	status  int
-	scheme  string
-	host    string
+	proxy         *Proxy
+	server        *httptest.Server
+	origin        *httptest.Server
+	options       Options
+	status        int
+	accept        string
+	cacheControl  string
+	contentType   string
+	chunked       bool
+	fetches       int32
+	revalidations int32
+	traceparent   string
+	upstreamTrace atomic.Value
+	scheme        string
+	host          string
 }
 
 func newProxyServer(delay time.Duration, timeout time.Duration) *proxyServer {
 	// Static http server that serves our test images, with a delay.
+	ps := &proxyServer{}
 	fs := http.FileServer(http.Dir(imageDirectory))
-	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ps.origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ps.fetches, 1)
+		ps.upstreamTrace.Store(r.Header.Get("Traceparent"))
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			atomic.AddInt32(&ps.revalidations, 1)
+		}
 		time.Sleep(delay)
+		if ps.cacheControl != "" {
+			w.Header().Set("Cache-Control", ps.cacheControl)
+		}
+		if ps.contentType != "" {
+			w.Header().Set("Content-Type", ps.contentType)
+		}
+		if ps.chunked {
+			w = chunkedWriter{w}
+		}
 		fs.ServeHTTP(w, r)
 	}))
 
-	url, err := url.Parse(origin.URL)
+	url, err := url.Parse(ps.origin.URL)
 	if err != nil {
 		panic("Bad origin URL")
 	}
 
-	ps := &proxyServer{
-		origin: origin,
-		scheme: url.Scheme,
-		host:   url.Host,
-	}
+	ps.scheme = url.Scheme
+	ps.host = url.Host
 
 	// Proxy http server that fetches and thumbnails images from origin
 	ps.proxy = NewProxy(ps.director, NewPool(0, 1), 2, &http.Client{Timeout: timeout})
@@ -99,8 +468,23 @@ func (ps *proxyServer) director(req *http.Request) (Options, int) {
 }
 
 func (ps *proxyServer) get(filename string) ([]byte, int) {
-	url := ps.server.URL + "/" + filename
-	resp, err := http.Get(url)
+	resp, body := ps.do(filename)
+	return body, resp.StatusCode
+}
+
+func (ps *proxyServer) do(filename string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", ps.server.URL+"/"+filename, nil)
+	if err != nil {
+		panic(err)
+	}
+	if ps.accept != "" {
+		req.Header.Set("Accept", ps.accept)
+	}
+	if ps.traceparent != "" {
+		req.Header.Set("Traceparent", ps.traceparent)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		panic(err)
 	}
@@ -111,7 +495,7 @@ func (ps *proxyServer) get(filename string) ([]byte, int) {
 		panic(err)
 	}
 
-	return body, resp.StatusCode
+	return resp, body
 }
 
 func (ps *proxyServer) getStatus(filename string) int {
@@ -143,3 +527,13 @@ func (ps *proxyServer) close() {
 	ps.proxy.Close()
 	ps.origin.Close()
 }
+
+// chunkedWriter hides Content-Length, so responses are sent chunked.
+type chunkedWriter struct {
+	http.ResponseWriter
+}
+
+func (w chunkedWriter) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,83 @@
+package thumbnail
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrDraining is returned by Ready once Drain or Close has been
+	// called.
+	ErrDraining = errors.New("Proxy is draining")
+	// ErrSaturated is returned by Ready when too many fetch slots are busy.
+	ErrSaturated = errors.New("Proxy is saturated")
+	// ErrSelfTestTimeout is returned by SelfTest when the Pool doesn't
+	// finish resizing a tiny image in time.
+	ErrSelfTestTimeout = errors.New("Self-test resize timed out")
+)
+
+// selfTestImage is a 2x3 pixel JPEG.
+var selfTestImage = []byte{
+	0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 0x4a, 0x46, 0x49, 0x46, 0x00, 0x01,
+	0x01, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0xff, 0xdb, 0x00, 0x84,
+	0x00, 0x03, 0x02, 0x02, 0x02, 0x02, 0x02, 0x03, 0x02, 0x02, 0x02, 0x03,
+	0x03, 0x03, 0x03, 0x04, 0x06, 0x04, 0x04, 0x04, 0x04, 0x04, 0x08, 0x06,
+	0x06, 0x05, 0x06, 0x09, 0x08, 0x0a, 0x0a, 0x09, 0x08, 0x09, 0x09, 0x0a,
+	0x0c, 0x0f, 0x0c, 0x0a, 0x0b, 0x0e, 0x0b, 0x09, 0x09, 0x0d, 0x11, 0x0d,
+	0x0e, 0x0f, 0x10, 0x10, 0x11, 0x10, 0x0a, 0x0c, 0x12, 0x13, 0x12, 0x10,
+	0x13, 0x0f, 0x10, 0x10, 0x10, 0x01, 0x03, 0x03, 0x03, 0x04, 0x03, 0x04,
+	0x08, 0x04, 0x04, 0x08, 0x10, 0x0b, 0x09, 0x0b, 0x10, 0x10, 0x10, 0x10,
+	0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10,
+	0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10,
+	0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10,
+	0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0xff, 0xc0,
+	0x00, 0x11, 0x08, 0x00, 0x03, 0x00, 0x02, 0x03, 0x01, 0x11, 0x00, 0x02,
+	0x11, 0x01, 0x03, 0x11, 0x01, 0xff, 0xc4, 0x00, 0x56, 0x00, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x04, 0x10, 0x01, 0x00, 0x02, 0x01, 0x05, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x03, 0x04, 0x21,
+	0x00, 0x02, 0x11, 0x12, 0x41, 0x01, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06,
+	0x11, 0x01, 0x01, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x01, 0x00, 0x21, 0xff, 0xda, 0x00,
+	0x0c, 0x03, 0x01, 0x00, 0x02, 0x11, 0x03, 0x11, 0x00, 0x3f, 0x00, 0x04,
+	0x16, 0xae, 0x10, 0x46, 0x17, 0xed, 0x87, 0x43, 0x80, 0xb1, 0xbc, 0x0c,
+	0x78, 0x0e, 0x34, 0x3a, 0x68, 0x5a, 0x4d, 0xe4, 0xd4, 0x64, 0x17, 0x22,
+	0x53, 0xb7, 0x7f, 0xff, 0xd9,
+}
+
+// SelfTest runs a tiny image through the Pool, returning an error if it
+// fails or doesn't finish within timeout.
+func (p *Pool) SelfTest(timeout time.Duration) error {
+	aborted := make(chan bool)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := p.Thumbnail(selfTestImage, Options{Width: 2, Height: 2, Crop: true}, aborted)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		close(aborted) // Skip the work if it's still queued.
+		return ErrSelfTestTimeout
+	}
+}
+
+// Ready returns nil if the Proxy can take more requests: it isn't
+// draining, no more than maxBusy (0.0-1.0, 0=unlimited) of its fetch
+// slots are in use, and its Pool passes SelfTest within timeout.
+func (p *Proxy) Ready(timeout time.Duration, maxBusy float64) error {
+	if atomic.LoadInt32(&p.draining) != 0 {
+		return ErrDraining
+	}
+
+	slots := cap(p.active)
+	if busy := slots - len(p.active); maxBusy > 0 && float64(busy) > maxBusy*float64(slots) {
+		return ErrSaturated
+	}
+
+	return p.pool.SelfTest(timeout)
+}
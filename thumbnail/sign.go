@@ -0,0 +1,46 @@
+package thumbnail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// SignPath returns path, including any thumbnail parameters, prefixed
+// with a path segment containing an HMAC-SHA256 signature of it made with
+// key. For example, "/image.jpg=s100x100" becomes "/<signature>/image.jpg=s100x100".
+// Path should be unescaped, as in url.URL.Path.  Query strings aren't
+// signed, so shouldn't be trusted on signed requests.
+func SignPath(key []byte, path string) string {
+	return "/" + pathSignature(key, path) + path
+}
+
+// VerifyPath checks that signed was made by SignPath with any of keys,
+// allowing keys to be rotated, and returns the path that was signed.
+func VerifyPath(keys [][]byte, signed string) (string, bool) {
+	if !strings.HasPrefix(signed, "/") {
+		return "", false
+	}
+
+	i := strings.Index(signed[1:], "/")
+	if i < 0 {
+		return "", false
+	}
+	sig, path := signed[1:i+1], signed[i+1:]
+
+	for _, key := range keys {
+		if hmac.Equal([]byte(sig), []byte(pathSignature(key, path))) {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+func pathSignature(key []byte, path string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	// Like base64.RawURLEncoding, which needs Go 1.5.
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(mac.Sum(nil)), "=")
+}
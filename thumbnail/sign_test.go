@@ -0,0 +1,34 @@
+package thumbnail
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignPath(t *testing.T) {
+	oldKey, newKey, otherKey := []byte("old"), []byte("new"), []byte("other")
+
+	signed := SignPath(newKey, "/dir/image.jpg=s100x100")
+	assert.Equal(t, 1+43+len("/dir/image.jpg=s100x100"), len(signed))
+
+	// Verifies against any of the current keys.
+	path, ok := VerifyPath([][]byte{newKey, oldKey}, signed)
+	assert.True(t, ok)
+	assert.Equal(t, "/dir/image.jpg=s100x100", path)
+	path, ok = VerifyPath([][]byte{oldKey, newKey}, SignPath(oldKey, "/image.jpg=c10x10"))
+	assert.True(t, ok)
+	assert.Equal(t, "/image.jpg=c10x10", path)
+
+	// Refuses other keys, tampering, and missing signatures.
+	for _, bad := range []string{
+		SignPath(otherKey, "/dir/image.jpg=s100x100"),
+		signed + "0",
+		"/dir/image.jpg=s100x100",
+		"/image.jpg",
+		"",
+	} {
+		_, ok = VerifyPath([][]byte{newKey, oldKey}, bad)
+		assert.False(t, ok, bad)
+	}
+}
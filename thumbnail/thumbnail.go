@@ -2,10 +2,12 @@ package thumbnail
 
 import (
 	"fmt"
+	"image/color"
 	"math"
 	"time"
 
 	"github.com/kitwalker12/fotomat/format"
+	"github.com/kitwalker12/fotomat/trace"
 	"github.com/kitwalker12/fotomat/vips"
 )
 
@@ -13,6 +15,14 @@ import (
 // Options specified in o and returns a compressed image.
 // Should be called from a thread pool with runtime.LockOSThread() locked.
 func Thumbnail(blob []byte, o Options) ([]byte, error) {
+	return thumbnail(blob, o, nil, nil)
+}
+
+// thumbnail is Thumbnail, tracing its load, resize, and save stages as
+// children of span.  VIPS evaluates lazily, so much of the decoding and
+// resizing work shows up in save.  If input isn't nil, it's set to the
+// original image's Metadata once that's known.
+func thumbnail(blob []byte, o Options, span *trace.Span, input *format.Metadata) ([]byte, error) {
 	if o.MaxProcessingDuration > 0 {
 		timer := time.AfterFunc(o.MaxProcessingDuration, func() {
 			panic(fmt.Sprintf("Thumbnail took longer than %v", o.MaxProcessingDuration))
@@ -23,10 +33,26 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 	// Free some thread-local caches. Safe to call unnecessarily.
 	defer vips.ThreadShutdown()
 
+	ls := span.Child("load")
+	defer ls.End()
+
+	// Refuse images that are too large before VIPS decodes anything.
+	if m, err := format.MetadataHeader(blob); err == nil {
+		if _, err := o.Check(m); err != nil {
+			return nil, err
+		}
+	}
+
 	m, err := format.MetadataBytes(blob)
 	if err != nil {
 		return nil, err
 	}
+	if input != nil {
+		*input = m
+	}
+	ls.SetAttribute("format", m.Format.String())
+	ls.SetAttribute("width", m.Width)
+	ls.SetAttribute("height", m.Height)
 
 	o, err = o.Check(m)
 	if err != nil {
@@ -38,13 +64,16 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 		o.Save.Lossless = false
 	}
 
-	// Figure out size to scale image down to.  For crop, this is the
-	// intermediate size the original image would have to be scaled to
-	// be cropped to requested size.
-	iw, ih, trustWidth := scaleAspect(m.Width, m.Height, o.Width, o.Height, !o.Crop)
+	// Figure out size to scale image to.
+	iw, ih, trustWidth := o.scaledSize(m)
 
 	// Are we shrinking by more than 2.5%?
 	shrinking := iw < m.Width-m.Width/40 && ih < m.Height-m.Height/40
+	sharpen := o.Sharpen && shrinking
+
+	if m.Frames > 1 && canAnimate(o.Save) {
+		return animation(blob, m, o, iw, ih, sharpen, span, ls)
+	}
 
 	// Figure out the jpeg/webp shrink factor and load image.
 	// Jpeg shrink rounds up the number of pixels.
@@ -58,38 +87,145 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 	if err := srgb(image); err != nil {
 		return nil, err
 	}
+	ls.End()
+
+	rs := span.Child("resize")
+	defer rs.End()
+	if err := transform(image, m.Orientation, o, iw, ih, sharpen, true); err != nil {
+		return nil, err
+	}
+	rs.End()
+
+	ss := span.Child("save")
+	defer ss.End()
+	return format.Save(image, o.Save)
+}
+
+// animation is like Thumbnail, but transforms each frame of an animated
+// image separately and reassembles them.  Frame delays and looping are
+// carried along in the metadata of the first frame.  Ends the load span
+// ls, and traces resize and save as children of span.
+func animation(blob []byte, m format.Metadata, o Options, iw, ih int, sharpen bool, span, ls *trace.Span) ([]byte, error) {
+	strip, err := loadPages(blob, m.Format)
+	if err != nil {
+		return nil, err
+	}
+	defer strip.Close()
+
+	if err := srgb(strip); err != nil {
+		return nil, err
+	}
+	ls.End()
+
+	rs := span.Child("resize")
+	defer rs.End()
+
+	// Every frame needs the same crop, or the animation would jitter.
+	if o.Gravity == GravityEntropy || o.Gravity == GravityAttention {
+		o.Gravity = GravityCenter
+	}
+
+	// Frames are stacked vertically, in physical orientation.
+	height := strip.Ysize() / m.Frames
+	if h, ok := strip.ImageGetInt(vips.MetaPageHeight); ok && h > 0 {
+		height = h
+	}
 
-	if err := resize(image, iw, ih, o.FastResize, o.BlurSigma, o.Sharpen && shrinking); err != nil {
+	frames := make([]*vips.Image, 0, strip.Ysize()/height)
+	defer func() {
+		for _, frame := range frames {
+			frame.Close()
+		}
+	}()
+
+	for top := 0; top+height <= strip.Ysize(); top += height {
+		frame, err := strip.Copy()
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+
+		if err := frame.ExtractArea(0, top, strip.Xsize(), height); err != nil {
+			return nil, err
+		}
+
+		// Don't flatten frames independently, or they'd stop matching.
+		if err := transform(frame, m.Orientation, o, iw, ih, sharpen, false); err != nil {
+			return nil, err
+		}
+	}
+
+	image, err := vips.Arrayjoin(frames, 1)
+	if err != nil {
 		return nil, err
 	}
+	defer image.Close()
+
+	image.ImageSetInt(vips.MetaPageHeight, frames[0].Ysize())
+	rs.End()
+
+	ss := span.Child("save")
+	defer ss.End()
+	return format.Save(image, o.Save)
+}
+
+// canAnimate returns true if an animated image saved with s stays animated.
+func canAnimate(s format.SaveOptions) bool {
+	switch s.Format {
+	case format.Unknown:
+		if s.AllowWebp {
+			return vips.AnimatedWebpSave
+		}
+		return vips.AnimatedGifSave
+	case format.Gif:
+		return vips.AnimatedGifSave
+	case format.Webp:
+		return vips.AnimatedWebpSave
+	default:
+		return false
+	}
+}
+
+// transform performs all of the per-frame work of Thumbnail on an image
+// that has already been loaded and converted to sRGB.
+func transform(image *vips.Image, orientation format.Orientation, o Options, iw, ih int, sharpen, flatten bool) error {
+	if err := resize(image, iw, ih, o.FastResize, o.Enlarge, o.BlurSigma, sharpen); err != nil {
+		return err
+	}
 
 	// Make sure we generate images with 8 bits per channel.  Do this before the
 	// rotate to reduce the amount of data that needs to be copied.
 	if image.ImageGetBandFormat() != vips.BandFormatUchar {
 		if err := image.Cast(vips.BandFormatUchar); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	if o.Crop {
-		if err = crop(image, o.Width, o.Height); err != nil {
-			return nil, err
+		if err := crop(image, o); err != nil {
+			return err
 		}
 	}
 
-	if image.HasAlpha() {
+	if flatten && image.HasAlpha() {
 		if min, err := minTransparency(image); err == nil && min >= 0.9 {
 			if err := image.Flatten(); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	if err := m.Orientation.Apply(image); err != nil {
-		return nil, err
+	if err := orientation.Apply(image); err != nil {
+		return err
 	}
 
-	return format.Save(image, o.Save)
+	if o.Pad {
+		if err := pad(image, o); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func load(blob []byte, f format.Format, shrink int) (*vips.Image, error) {
@@ -104,6 +240,17 @@ func load(blob []byte, f format.Format, shrink int) (*vips.Image, error) {
 	return f.LoadBytes(blob)
 }
 
+func loadPages(blob []byte, f format.Format) (*vips.Image, error) {
+	switch f {
+	case format.Gif:
+		return vips.GifloadBufferPages(blob, -1)
+	case format.Webp:
+		return vips.WebploadBufferPages(blob, -1)
+	}
+
+	return f.LoadBytes(blob)
+}
+
 func srgb(image *vips.Image) error {
 	// Transform from embedded ICC profile if present or default profile
 	// if CMYK.  Ignore errors.
@@ -123,7 +270,7 @@ func srgb(image *vips.Image) error {
 	return nil
 }
 
-func resize(image *vips.Image, iw, ih int, fastResize bool, blurSigma float64, sharpen bool) error {
+func resize(image *vips.Image, iw, ih int, fastResize, enlarge bool, blurSigma float64, sharpen bool) error {
 	m := format.MetadataImage(image)
 
 	// Interpolation of RGB values with an alpha channel isn't safe
@@ -158,6 +305,10 @@ func resize(image *vips.Image, iw, ih int, fastResize bool, blurSigma float64, s
 		if err := image.Resize((float64(iw)+vips.ResizeOffset)/float64(m.Width), (float64(ih)+vips.ResizeOffset)/float64(m.Height)); err != nil {
 			return err
 		}
+	} else if enlarge && (iw > m.Width || ih > m.Height) {
+		if err := upsample(image, m.Orientation, iw, ih); err != nil {
+			return err
+		}
 	}
 
 	if blurSigma > 0.0 {
@@ -182,18 +333,39 @@ func resize(image *vips.Image, iw, ih int, fastResize bool, blurSigma float64, s
 	return nil
 }
 
-func crop(image *vips.Image, ow, oh int) error {
+func upsample(image *vips.Image, orientation format.Orientation, iw, ih int) error {
+	interpolate := vips.NewInterpolate("nohalo")
+	if interpolate == nil {
+		return vips.ErrImageOp
+	}
+	defer interpolate.Close()
+
+	// Upsample works on physical pixels.
+	w, h := orientation.Dimensions(iw, ih)
+	return image.Upsample(w, h, interpolate)
+}
+
+func crop(image *vips.Image, o Options) error {
 	m := format.MetadataImage(image)
+	ow, oh := o.Width, o.Height
 
 	// If we have nothing to do, return.
 	if ow == m.Width && oh == m.Height {
 		return nil
 	}
 
-	// Center horizontally
-	x := (m.Width - ow + 1) / 2
-	// Assume faces are higher up vertically
-	y := (m.Height - oh + 1) / 4
+	var x, y int
+	switch o.Gravity {
+	case GravityEntropy:
+		return smartcrop(image, m, ow, oh, vips.InterestingEntropy)
+	case GravityAttention:
+		return smartcrop(image, m, ow, oh, vips.InterestingAttention)
+	case GravityFocus:
+		x = focusOffset(o.FocusX, m.Width, ow)
+		y = focusOffset(o.FocusY, m.Height, oh)
+	default:
+		x, y = gravityOffset(o.Gravity, m.Width-ow, m.Height-oh)
+	}
 
 	if x < 0 || y < 0 {
 		panic("Bad crop offsets!")
@@ -201,3 +373,98 @@ func crop(image *vips.Image, ow, oh int) error {
 
 	return image.ExtractArea(m.Orientation.Crop(ow, oh, x, y, m.Width, m.Height))
 }
+
+func pad(image *vips.Image, o Options) error {
+	// Called after orientation is applied, so physical is virtual here.
+	w, h := image.Xsize(), image.Ysize()
+
+	// If we have nothing to do, return.
+	if o.Width == w && o.Height == h {
+		return nil
+	}
+
+	// Only compass gravities make sense for placement; center otherwise.
+	gravity := GravityCenter
+	switch o.Gravity {
+	case GravityNorth, GravitySouth, GravityEast, GravityWest:
+		gravity = o.Gravity
+	}
+	x, y := gravityOffset(gravity, o.Width-w, o.Height-h)
+
+	// Background needs one value per band, so always pad in color.
+	if image.ImageGuessInterpretation() != vips.InterpretationSRGB {
+		if err := image.Colourspace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+
+	background := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	if o.Background != nil {
+		background = *o.Background
+	}
+
+	bg := []float64{float64(background.R), float64(background.G), float64(background.B)}
+	if background.A == 255 {
+		if image.HasAlpha() {
+			if err := image.FlattenBackground(bg); err != nil {
+				return err
+			}
+		}
+	} else {
+		if !image.HasAlpha() {
+			if err := image.BandjoinConst([]float64{image.MaxAlpha()}); err != nil {
+				return err
+			}
+		}
+		bg = append(bg, float64(background.A))
+	}
+
+	return image.EmbedBackground(x, y, o.Width, o.Height, bg)
+}
+
+// gravityOffset returns the offset of the crop window within dx by dy
+// pixels of excess width and height.
+func gravityOffset(gravity Gravity, dx, dy int) (int, int) {
+	switch gravity {
+	case GravityCenter:
+		return (dx + 1) / 2, (dy + 1) / 2
+	case GravityNorth:
+		return (dx + 1) / 2, 0
+	case GravitySouth:
+		return (dx + 1) / 2, dy
+	case GravityEast:
+		return dx, (dy + 1) / 2
+	case GravityWest:
+		return 0, (dy + 1) / 2
+	default:
+		// Center horizontally, but assume faces are higher up vertically.
+		return (dx + 1) / 2, (dy + 1) / 4
+	}
+}
+
+// focusOffset returns the offset of a window of length window that puts
+// the point fraction f along length size as close to its center as possible.
+func focusOffset(f float64, size, window int) int {
+	offset := int(math.Floor(f*float64(size) - float64(window)/2 + 0.5))
+	if offset > size-window {
+		offset = size - window
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
+
+func smartcrop(image *vips.Image, m format.Metadata, ow, oh int, interesting vips.Interesting) error {
+	// Content-aware crops look at pixels, so only the size of the
+	// window needs translating to the physical orientation.
+	_, _, pw, ph := m.Orientation.Crop(ow, oh, 0, 0, m.Width, m.Height)
+
+	// Smartcrop reads the image more than once, so we copy memory here
+	// to stay sequential.
+	if err := image.Write(); err != nil {
+		return err
+	}
+
+	return image.Smartcrop(pw, ph, interesting)
+}
@@ -2,6 +2,7 @@ package thumbnail
 
 import (
 	"fmt"
+	"image/color"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -90,6 +91,36 @@ func TestThumbnail(t *testing.T) {
 	}
 }
 
+func TestEnlarge(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// Verify scaling up to fit completely into box.
+	thumb, err := Thumbnail(img, Options{Width: 1000, Height: 1000, Enlarge: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 743, 1000, false))
+	}
+
+	// Verify scaling up no more than MaxEnlarge.
+	thumb, err = Thumbnail(img, Options{Width: 1000, Height: 1000, Enlarge: true, MaxEnlarge: 1.5})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 597, 804, false))
+	}
+
+	// Verify scaling up to crop.
+	thumb, err = Thumbnail(img, Options{Width: 800, Height: 400, Crop: true, Enlarge: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 800, 400, false))
+	}
+
+	for i := 0; i <= 8; i++ {
+		// Verify that enlarging maintains orientation.
+		thumb, err := Thumbnail(image("orient"+strconv.Itoa(i)+".jpg"), Options{Width: 120, Height: 120, Enlarge: true})
+		if assert.Nil(t, err, "orient: %d", i) {
+			assert.Nil(t, isSize(thumb, format.Jpeg, 72, 120, false), "orient: %d", i)
+		}
+	}
+}
+
 func TestCrop(t *testing.T) {
 	img := image("watermelon.jpg")
 
@@ -117,6 +148,171 @@ func TestCrop(t *testing.T) {
 	}
 }
 
+func TestCropGravity(t *testing.T) {
+	for g := GravityDefault; g < gravityLimit; g++ {
+		// Verify that smart crops are refused rather than faked.
+		if (g == GravityEntropy || g == GravityAttention) && !vips.SmartcropSupported {
+			_, err := Thumbnail(image("watermelon.jpg"), Options{Width: 300, Height: 200, Crop: true, Gravity: g})
+			assert.Equal(t, ErrBadOption, err, "gravity: %d", g)
+			continue
+		}
+
+		// Verify that each gravity crops to the requested size.
+		thumb, err := Thumbnail(image("watermelon.jpg"), Options{Width: 300, Height: 200, Crop: true, Gravity: g})
+		if assert.Nil(t, err, "gravity: %d", g) {
+			assert.Nil(t, isSize(thumb, format.Jpeg, 300, 200, false), "gravity: %d", g)
+		}
+
+		// Verify that each gravity crops rotated images correctly.
+		for i := 0; i <= 8; i++ {
+			thumb, err := Thumbnail(image("orient"+strconv.Itoa(i)+".jpg"), Options{Width: 40, Height: 20, Crop: true, Gravity: g})
+			if assert.Nil(t, err, "gravity: %d, orient: %d", g, i) {
+				assert.Nil(t, isSize(thumb, format.Jpeg, 40, 20, false), "gravity: %d, orient: %d", g, i)
+			}
+		}
+	}
+}
+
+func TestGravityOffset(t *testing.T) {
+	var offsetTest = []struct {
+		gravity Gravity
+		x, y    int
+	}{
+		{GravityDefault, 50, 25},
+		{GravityCenter, 50, 50},
+		{GravityNorth, 50, 0},
+		{GravitySouth, 50, 100},
+		{GravityEast, 100, 50},
+		{GravityWest, 0, 50},
+	}
+	for _, o := range offsetTest {
+		x, y := gravityOffset(o.gravity, 100, 100)
+		assert.Equal(t, o.x, x, "gravity: %d", o.gravity)
+		assert.Equal(t, o.y, y, "gravity: %d", o.gravity)
+	}
+}
+
+func TestFocusOffset(t *testing.T) {
+	// Center the window on the focal point when possible.
+	assert.Equal(t, 25, focusOffset(0.5, 100, 50))
+	assert.Equal(t, 10, focusOffset(0.35, 100, 50))
+
+	// Otherwise keep the window within the image.
+	assert.Equal(t, 0, focusOffset(0.0, 100, 50))
+	assert.Equal(t, 0, focusOffset(0.1, 100, 50))
+	assert.Equal(t, 50, focusOffset(0.9, 100, 50))
+	assert.Equal(t, 50, focusOffset(1.0, 100, 50))
+	assert.Equal(t, 0, focusOffset(0.5, 100, 100))
+}
+
+func TestCropFocus(t *testing.T) {
+	for i := 0; i <= 8; i++ {
+		// Verify that focal points are placed correctly on rotated images.
+		thumb, err := Thumbnail(image("orient"+strconv.Itoa(i)+".jpg"), Options{Width: 20, Height: 20, Crop: true, Gravity: GravityFocus, FocusX: 0.9, FocusY: 0.1})
+		if assert.Nil(t, err, "orient: %d", i) {
+			assert.Nil(t, isSize(thumb, format.Jpeg, 20, 20, false), "orient: %d", i)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// Verify padding onto an opaque background.
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	thumb, err := Thumbnail(img, Options{Width: 300, Height: 300, Pad: true, Background: &white})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 300, 300, false))
+	}
+
+	// Verify that the canvas is opaque white by default.
+	thumb, err = Thumbnail(img, Options{Width: 300, Height: 300, Pad: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 300, 300, false))
+	}
+
+	// Verify padding onto a transparent background.
+	thumb, err = Thumbnail(img, Options{Width: 300, Height: 300, Pad: true, Gravity: GravityNorth, Background: &color.NRGBA{}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 300, 300, true))
+	}
+
+	// Verify padding without scaling up.
+	thumb, err = Thumbnail(img, Options{Width: 1000, Height: 1000, Pad: true, Background: &white})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 1000, 1000, false))
+	}
+
+	// Verify padding an image that already has alpha.
+	thumb, err = Thumbnail(image("somealpha.png"), Options{Width: 100, Height: 100, Pad: true, Background: &white})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 100, 100, false))
+	}
+
+	for i := 0; i <= 8; i++ {
+		// Verify that padding happens after rotation.
+		thumb, err := Thumbnail(image("orient"+strconv.Itoa(i)+".jpg"), Options{Width: 40, Height: 20, Pad: true, Background: &white})
+		if assert.Nil(t, err, "orient: %d", i) {
+			assert.Nil(t, isSize(thumb, format.Jpeg, 40, 20, false), "orient: %d", i)
+		}
+	}
+}
+
+func TestAnimation(t *testing.T) {
+	if !vips.AnimatedWebpSave {
+		t.Skip("VIPS can't save animated WebP")
+	}
+
+	img := image("animated.gif")
+
+	// Verify that all frames are scaled and saved as an animated WebP.
+	thumb, err := Thumbnail(img, Options{Width: 30, Height: 30, Save: format.SaveOptions{AllowWebp: true}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isAnimation(thumb, format.Webp, 30, 20, 3))
+
+		// Verify that animated WebPs can be cropped too.
+		thumb, err = Thumbnail(thumb, Options{Width: 16, Height: 16, Crop: true, Gravity: GravityAttention, Save: format.SaveOptions{Format: format.Webp}})
+		if assert.Nil(t, err) {
+			assert.Nil(t, isAnimation(thumb, format.Webp, 16, 16, 3))
+		}
+	}
+
+	// Verify that asking for a format that can't animate keeps one frame.
+	thumb, err = Thumbnail(img, Options{Width: 30, Height: 30, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isAnimation(thumb, format.Png, 30, 20, 1))
+	}
+
+	if vips.AnimatedGifSave {
+		// Verify that animated GIFs stay GIFs by default.
+		thumb, err = Thumbnail(img, Options{Width: 30, Height: 30, Pad: true})
+		if assert.Nil(t, err) {
+			assert.Nil(t, isAnimation(thumb, format.Gif, 30, 30, 3))
+		}
+	}
+
+	// Verify that frame limits are applied.
+	_, err = Thumbnail(img, Options{Width: 30, Height: 30, MaxFrames: 2})
+	assert.Equal(t, err, ErrTooManyFrames)
+}
+
+func isAnimation(image []byte, f format.Format, width, height, frames int) error {
+	m, err := format.MetadataBytes(image)
+	if err != nil {
+		return err
+	}
+	if m.Width != width || m.Height != height {
+		return fmt.Errorf("Got %dx%d != want %dx%d", m.Width, m.Height, width, height)
+	}
+	if m.Format != f {
+		return fmt.Errorf("Format %s!=%s", m.Format, f)
+	}
+	if m.Frames != frames {
+		return fmt.Errorf("Frames %d!=%d", m.Frames, frames)
+	}
+	return nil
+}
+
 func TestBlurSharpen(t *testing.T) {
 	img := image("watermelon.jpg")
 
@@ -0,0 +1,265 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WriterExporter writes each span to an io.Writer as a line of JSON.
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterExporter creates a WriterExporter that writes to w, eg.
+// os.Stdout.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+type writerSpan struct {
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Start      string                 `json:"start"`
+	Duration   float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Export writes s.
+func (e *WriterExporter) Export(s *SpanData) {
+	ws := writerSpan{
+		Name:     s.Name,
+		TraceID:  s.TraceID.String(),
+		SpanID:   s.SpanID.String(),
+		Start:    s.Start.UTC().Format(time.RFC3339Nano),
+		Duration: float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+		Error:    s.Error,
+	}
+	if s.ParentID != (SpanID{}) {
+		ws.ParentID = s.ParentID.String()
+	}
+	if len(s.Attributes) > 0 {
+		ws.Attributes = map[string]interface{}{}
+		for _, a := range s.Attributes {
+			ws.Attributes[a.Key] = a.Value
+		}
+	}
+
+	line, err := json.Marshal(ws)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	e.w.Write(line)
+	e.mu.Unlock()
+}
+
+const (
+	otlpBatchSize  = 512
+	otlpQueueSize  = 8192
+	otlpBatchDelay = time.Second
+)
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector using
+// OTLP's JSON encoding over HTTP.  Spans are dropped if the collector
+// can't keep up.  Must be created with NewOTLPExporter.
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	queue   chan *SpanData
+	done    chan bool
+}
+
+// NewOTLPExporter creates an OTLPExporter that POSTs to url, eg.
+// "http://127.0.0.1:4318/v1/traces", identifying spans as coming from
+// service.
+func NewOTLPExporter(url, service string, client *http.Client) *OTLPExporter {
+	e := &OTLPExporter{
+		url:     url,
+		service: service,
+		client:  client,
+		queue:   make(chan *SpanData, otlpQueueSize),
+		done:    make(chan bool),
+	}
+
+	go e.run()
+
+	return e
+}
+
+// Export queues s to be sent.
+func (e *OTLPExporter) Export(s *SpanData) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+// Close sends any queued spans and stops e.  Export must not be called
+// afterward.
+func (e *OTLPExporter) Close() error {
+	close(e.queue)
+	<-e.done
+	return nil
+}
+
+func (e *OTLPExporter) run() {
+	var batch []*SpanData
+	ticker := time.NewTicker(otlpBatchDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.send(batch)
+				close(e.done)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		e.send(batch)
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) send(batch []*SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		log.Println("OTLP export:", err)
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("OTLP export:", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("OTLP export: %s returned %s", e.url, resp.Status)
+	}
+}
+
+// OTLP's JSON encoding of an ExportTraceServiceRequest.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+func (e *OTLPExporter) request(batch []*SpanData) otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		o := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentID != (SpanID{}) {
+			o.ParentSpanID = s.ParentID.String()
+		}
+		for _, a := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpAttr(a.Key, a.Value))
+		}
+		if s.Error != "" {
+			o.Status = &otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		spans[i] = o
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", e.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: e.service}, Spans: spans}},
+	}}}
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
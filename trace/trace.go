@@ -0,0 +1,242 @@
+// Package trace records spans describing how long each stage of a request
+// took, propagates them using the W3C Trace Context traceparent header,
+// and exports them as JSON lines or to an OpenTelemetry (OTLP) collector,
+// without any dependencies.
+//
+// A nil *Tracer or *Span is valid and does nothing, so callers don't need
+// to check whether tracing is enabled.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span that is propagated to other services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if c has a nonzero TraceID and SpanID.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// ParseTraceparent parses a traceparent header, eg.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".  Returns false
+// if it isn't valid.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	// Later versions may append fields, but must start the same way.
+	if len(s) < 55 || (len(s) > 55 && (s[:2] == "00" || s[55] != '-')) {
+		return SpanContext{}, false
+	}
+	if s[2] != '-' || s[35] != '-' || s[52] != '-' || s[:2] == "ff" {
+		return SpanContext{}, false
+	}
+
+	var c SpanContext
+	var version, flags [1]byte
+	if !decodeHex(version[:], s[:2]) || !decodeHex(c.TraceID[:], s[3:35]) ||
+		!decodeHex(c.SpanID[:], s[36:52]) || !decodeHex(flags[:], s[53:55]) {
+		return SpanContext{}, false
+	}
+	if !c.IsValid() {
+		return SpanContext{}, false
+	}
+
+	c.Sampled = flags[0]&1 != 0
+	return c, true
+}
+
+// Traceparent formats c as a traceparent header.
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + c.TraceID.String() + "-" + c.SpanID.String() + "-" + flags
+}
+
+// decodeHex decodes lowercase hex, as required by traceparent.
+func decodeHex(dst []byte, s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// Attribute is a key and a string, int, int64, float64, or bool value
+// describing a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData is a finished span, as passed to an Exporter.
+type SpanData struct {
+	Name       string
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	// Error, if not empty, describes why the operation failed.
+	Error string
+}
+
+// Exporter sends finished spans somewhere.  Export must be safe to call
+// from multiple goroutines, and shouldn't block.
+type Exporter interface {
+	Export(s *SpanData)
+}
+
+// Tracer starts spans and passes them to an Exporter when they end.
+type Tracer struct {
+	// Sample is the fraction of new traces that are sampled (0.0-1.0).
+	// Traces continued from a parent follow the parent's decision.
+	Sample   float64
+	exporter Exporter
+}
+
+// NewTracer creates a Tracer that exports to e, sampling every trace.
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{Sample: 1.0, exporter: e}
+}
+
+// Start starts a span.  If parent is valid, the span is its child, and is
+// only exported if parent is sampled.  Otherwise, it starts a new trace,
+// sampled according to Sample.  End must be called when the operation is
+// done.
+func (t *Tracer) Start(name string, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{tracer: t, data: SpanData{Name: name, Start: time.Now()}}
+	s.context.SpanID = newSpanID()
+	if parent.IsValid() {
+		s.context.TraceID = parent.TraceID
+		s.context.Sampled = parent.Sampled
+		s.data.ParentID = parent.SpanID
+	} else {
+		s.context.TraceID = newTraceID()
+		s.context.Sampled = t.sampled(s.context.TraceID)
+	}
+	s.data.TraceID, s.data.SpanID = s.context.TraceID, s.context.SpanID
+
+	return s
+}
+
+// Span is an operation being timed.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	mu      sync.Mutex
+	data    SpanData
+	ended   bool
+}
+
+// Child starts a span for an operation that is part of s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.Start(name, s.context)
+}
+
+// Context returns the SpanContext to propagate to other services, or the
+// zero SpanContext if s is nil.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute adds an attribute describing s.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.data.Attributes = append(s.data.Attributes, Attribute{Key: key, Value: value})
+	s.mu.Unlock()
+}
+
+// SetError marks s as failed with err, if err isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.data.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes s and exports it if it's sampled.  Calls after the first
+// are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	d := s.data
+	s.mu.Unlock()
+
+	if s.context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(&d)
+	}
+}
+
+// sampled decides whether a new trace is sampled from the random low bits
+// of its id, as OpenTelemetry's TraceIdRatioBased sampler does.
+func (t *Tracer) sampled(id TraceID) bool {
+	if t.Sample >= 1.0 {
+		return true
+	}
+	if t.Sample <= 0.0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < uint64(t.Sample*(1<<63))
+}
+
+func newTraceID() (t TraceID) {
+	for t == (TraceID{}) {
+		rand.Read(t[:])
+	}
+	return t
+}
+
+func newSpanID() (s SpanID) {
+	for s == (SpanID{}) {
+		rand.Read(s[:])
+	}
+	return s
+}
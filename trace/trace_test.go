@@ -0,0 +1,183 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c, ok := ParseTraceparent(tp)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", c.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", c.SpanID.String())
+	assert.True(t, c.Sampled)
+	assert.Equal(t, tp, c.Traceparent())
+
+	c, ok = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, c.Sampled)
+
+	// Later versions may add fields.
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(bad)
+		assert.False(t, ok, bad)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	e := &recorder{}
+	tr := NewTracer(e)
+
+	// A new trace is started without a valid parent.
+	root := tr.Start("root", SpanContext{})
+	assert.True(t, root.Context().IsValid())
+	assert.True(t, root.Context().Sampled)
+
+	child := root.Child("child")
+	child.SetAttribute("width", 200)
+	child.SetError(errors.New("Too big"))
+	child.SetError(nil)
+	child.End()
+	child.End()
+	root.End()
+
+	assert.Equal(t, 2, len(e.spans))
+	assert.Equal(t, "child", e.spans[0].Name)
+	assert.Equal(t, root.Context().TraceID, e.spans[0].TraceID)
+	assert.Equal(t, root.Context().SpanID, e.spans[0].ParentID)
+	assert.Equal(t, []Attribute{{"width", 200}}, e.spans[0].Attributes)
+	assert.Equal(t, "Too big", e.spans[0].Error)
+	assert.Equal(t, SpanID{}, e.spans[1].ParentID)
+	assert.False(t, e.spans[1].End.Before(e.spans[1].Start))
+
+	// Spans continue an incoming trace, and aren't exported if it isn't
+	// sampled.
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	s := tr.Start("unsampled", parent)
+	assert.Equal(t, parent.TraceID, s.Context().TraceID)
+	assert.NotEqual(t, parent.SpanID, s.Context().SpanID)
+	assert.False(t, s.Context().Sampled)
+	s.End()
+	assert.Equal(t, 2, len(e.spans))
+
+	// New traces are sampled at the configured rate.
+	tr.Sample = 0.0
+	assert.False(t, tr.Start("root", SpanContext{}).Context().Sampled)
+	tr.Sample = 0.5
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if tr.Start("root", SpanContext{}).Context().Sampled {
+			sampled++
+		}
+	}
+	assert.True(t, sampled > 400 && sampled < 600, "sampled: %d", sampled)
+
+	// But continued traces still follow their parent.
+	parent.Sampled = true
+	assert.True(t, tr.Start("child", parent).Context().Sampled)
+	tr.Sample = 0.0
+	assert.True(t, tr.Start("child", parent).Context().Sampled)
+
+	// Nil tracers and spans do nothing.
+	var nt *Tracer
+	ns := nt.Start("nil", parent)
+	assert.Nil(t, ns)
+	assert.Nil(t, ns.Child("nil"))
+	assert.False(t, ns.Context().IsValid())
+	ns.SetAttribute("a", "b")
+	ns.SetError(errors.New("Ignored"))
+	ns.End()
+}
+
+func TestWriterExporter(t *testing.T) {
+	var b bytes.Buffer
+	tr := NewTracer(NewWriterExporter(&b))
+	root := tr.Start("root", SpanContext{})
+	child := root.Child("child")
+	child.SetAttribute("format", "image/jpeg")
+	child.End()
+	root.End()
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var ws writerSpan
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &ws))
+	assert.Equal(t, "child", ws.Name)
+	assert.Equal(t, root.Context().TraceID.String(), ws.TraceID)
+	assert.Equal(t, root.Context().SpanID.String(), ws.ParentID)
+	assert.Equal(t, "image/jpeg", ws.Attributes["format"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer collector.Close()
+
+	e := NewOTLPExporter(collector.URL+"/v1/traces", "fotomat", &http.Client{})
+	tr := NewTracer(e)
+	root := tr.Start("root", SpanContext{})
+	child := root.Child("child")
+	child.SetAttribute("width", 200)
+	child.SetAttribute("cached", true)
+	child.SetError(errors.New("Too big"))
+	child.End()
+	root.End()
+	assert.Nil(t, e.Close())
+
+	var req otlpRequest
+	assert.Nil(t, json.Unmarshal(<-bodies, &req))
+	rs := req.ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "fotomat", rs.Resource.Attributes[0].Value["stringValue"])
+
+	spans := rs.ScopeSpans[0].Spans
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, root.Context().TraceID.String(), spans[0].TraceID)
+	assert.Equal(t, root.Context().SpanID.String(), spans[0].ParentSpanID)
+	assert.Equal(t, "200", spans[0].Attributes[0].Value["intValue"])
+	assert.Equal(t, true, spans[0].Attributes[1].Value["boolValue"])
+	assert.Equal(t, otlpStatusError, spans[0].Status.Code)
+	assert.Equal(t, "", spans[1].ParentSpanID)
+	assert.Nil(t, spans[1].Status)
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (r *recorder) Export(s *SpanData) {
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+}
@@ -6,6 +6,10 @@ package vips
 */
 import "C"
 
+import (
+	"unsafe"
+)
+
 // Extend specifies how to extend edges of an image
 type Extend int
 
@@ -30,6 +34,18 @@ const (
 	Angle270 Angle = C.VIPS_ANGLE_D270 // 90 degrees clockwise
 )
 
+// Interesting specifies which strategy Smartcrop uses to find the most
+// interesting part of an image.
+type Interesting int
+
+// Various Interesting values understood by VIPS.
+const (
+	InterestingNone      Interesting = C.VIPS_INTERESTING_NONE      // crop from the top left
+	InterestingCentre    Interesting = C.VIPS_INTERESTING_CENTRE    // crop from the centre
+	InterestingEntropy   Interesting = C.VIPS_INTERESTING_ENTROPY   // crop to maximise entropy
+	InterestingAttention Interesting = C.VIPS_INTERESTING_ATTENTION // crop to features likely to draw attention
+)
+
 // Direction specifies which direction to flip an image
 type Direction int
 
@@ -39,6 +55,31 @@ const (
 	DirectionVertical   Direction = C.VIPS_DIRECTION_VERTICAL   // top-bottom
 )
 
+// Arrayjoin lays out images in a grid across images wide and returns the
+// result as a new Image.  Metadata is copied from the first image.
+func Arrayjoin(images []*Image, across int) (*Image, error) {
+	if len(images) == 0 {
+		return nil, ErrImageOp
+	}
+
+	in := make([]*C.struct__VipsImage, len(images))
+	for i, image := range images {
+		in[i] = image.vi
+	}
+
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_arrayjoin(&in[0], &out, C.int(len(in)), C.int(across))
+	return loadError(out, e)
+}
+
+// BandjoinConst appends one band per value in c to in, with every pixel
+// set to that value.
+func (in *Image) BandjoinConst(c []float64) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_bandjoin_const(in.vi, &out, (*C.double)(unsafe.Pointer(&c[0])), C.int(len(c)))
+	return in.imageError(out, e)
+}
+
 // Cast converts in to BandFormat. Floats are truncated (not rounded). Out of range values are clipped.
 func (in *Image) Cast(format BandFormat) error {
 	var out *C.struct__VipsImage
@@ -61,6 +102,15 @@ func (in *Image) Embed(left, top, width, height int, extend Extend) error {
 	return in.imageError(out, e)
 }
 
+// EmbedBackground embeds in within an image of size width by height at
+// position x, y, filling the new pixels with background, which must have
+// one value per band of in.
+func (in *Image) EmbedBackground(left, top, width, height int, background []float64) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_embed_background(in.vi, &out, C.int(left), C.int(top), C.int(width), C.int(height), (*C.double)(unsafe.Pointer(&background[0])), C.int(len(background)))
+	return in.imageError(out, e)
+}
+
 // ExtractArea extract an area from an image. The area must fit within in.
 func (in *Image) ExtractArea(left, top, width, height int) error {
 	var out *C.struct__VipsImage
@@ -83,6 +133,15 @@ func (in *Image) Flatten() error {
 	return in.imageError(out, e)
 }
 
+// FlattenBackground takes the last band of in as an alpha and use it to
+// blend the remaining channels with background, then remove the alpha
+// channel.
+func (in *Image) FlattenBackground(background []float64) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_flatten_background(in.vi, &out, (*C.double)(unsafe.Pointer(&background[0])), C.int(len(background)))
+	return in.imageError(out, e)
+}
+
 // Flip an image left-right or up-down.
 func (in *Image) Flip(direction Direction) error {
 	var out *C.struct__VipsImage
@@ -109,6 +168,14 @@ func (in *Image) Rot(angle Angle) error {
 	return in.imageError(out, e)
 }
 
+// Smartcrop crops in to width by height, keeping the area selected by
+// interesting.  Returns an error before VIPS 8.5; check SmartcropSupported.
+func (in *Image) Smartcrop(width, height int, interesting Interesting) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_smartcrop(in.vi, &out, C.int(width), C.int(height), C.int(interesting))
+	return in.imageError(out, e)
+}
+
 // Unpremultiply any alpha channel. The final band is taken to be the alpha.
 func (in *Image) Unpremultiply() error {
 	var out *C.struct__VipsImage
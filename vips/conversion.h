@@ -9,6 +9,23 @@
 #define VIPS_ANGLE_D270 VIPS_ANGLE_270
 #endif
 
+#if (VIPS_MAJOR_VERSION < 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION < 5))
+#define VIPS_INTERESTING_NONE 0
+#define VIPS_INTERESTING_CENTRE 1
+#define VIPS_INTERESTING_ENTROPY 2
+#define VIPS_INTERESTING_ATTENTION 3
+#endif
+
+int
+cgo_vips_arrayjoin(VipsImage **in, VipsImage **out, int n, int across) {
+    return vips_arrayjoin(in, out, n, "across", across, NULL);
+}
+
+int
+cgo_vips_bandjoin_const(VipsImage *in, VipsImage **out, double *c, int n) {
+    return vips_bandjoin_const(in, out, c, n, NULL);
+}
+
 int
 cgo_vips_cast(VipsImage *in, VipsImage **out, VipsBandFormat format) {
     return vips_cast(in, out, format, NULL);
@@ -24,6 +41,14 @@ cgo_vips_embed(VipsImage *in, VipsImage **out, int left, int top, int width, int
     return vips_embed(in, out, left, top, width, height, "extend", extend, NULL);
 }
 
+int
+cgo_vips_embed_background(VipsImage *in, VipsImage **out, int left, int top, int width, int height, double *background, int n) {
+    VipsArrayDouble *array = vips_array_double_new(background, n);
+    int e = vips_embed(in, out, left, top, width, height, "extend", VIPS_EXTEND_BACKGROUND, "background", array, NULL);
+    vips_area_unref(VIPS_AREA(array));
+    return e;
+}
+
 int
 cgo_vips_extract_area(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
     return vips_extract_area(in, out, left, top, width, height, NULL);
@@ -52,6 +77,14 @@ cgo_vips_flatten(VipsImage *in, VipsImage **out) {
     return vips_flatten(in, out, "max_alpha", cgo_max_alpha(in), NULL);
 }
 
+int
+cgo_vips_flatten_background(VipsImage *in, VipsImage **out, double *background, int n) {
+    VipsArrayDouble *array = vips_array_double_new(background, n);
+    int e = vips_flatten(in, out, "max_alpha", cgo_max_alpha(in), "background", array, NULL);
+    vips_area_unref(VIPS_AREA(array));
+    return e;
+}
+
 int
 cgo_vips_flip(VipsImage *in, VipsImage **out, VipsDirection direction) {
     return vips_flip(in, out, direction, NULL);
@@ -67,6 +100,16 @@ cgo_vips_rot(VipsImage *in, VipsImage **out, VipsAngle angle) {
     return vips_rot(in, out, angle, NULL);
 }
 
+int
+cgo_vips_smartcrop(VipsImage *in, VipsImage **out, int width, int height, int interesting) {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 5
+    return vips_smartcrop(in, out, width, height, "interesting", interesting, NULL);
+#else
+    vips_error("smartcrop", "smartcrop requires VIPS 8.5 or later");
+    return -1;
+#endif
+}
+
 int
 cgo_vips_unpremultiply(VipsImage *in, VipsImage **out) {
     // Assumes we're converting to uchar and uses default max_alpha of 255.
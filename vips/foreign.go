@@ -26,6 +26,70 @@ func GifloadBuffer(buf []byte) (*Image, error) {
 	return loadError(out, e)
 }
 
+// GifloadBufferPages reads n frames of a GIF byte slice into a single
+// Image, with frames stacked vertically.  Pass -1 to read all frames.  VIPS
+// versions before 8.5 only ever read the first frame.
+func GifloadBufferPages(buf []byte, n int) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_gifload_buffer_pages(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(n))
+	return loadError(out, e)
+}
+
+// GifsaveBuffer writes an Image to a GIF byte slice.  If MetaPageHeight is
+// set, the image is saved as an animation of frames that tall.  Requires
+// VIPS 8.12 or later.
+func (in *Image) GifsaveBuffer() ([]byte, error) {
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+
+	e := C.cgo_vips_gifsave_buffer(in.vi, &ptr, &length)
+
+	return saveError(ptr, length, e)
+}
+
+// HeifCompression is the codec used to compress a HEIF image.
+type HeifCompression int
+
+// Various HeifCompression values understood by VIPS.
+const (
+	HeifCompressionHevc HeifCompression = C.VIPS_FOREIGN_HEIF_COMPRESSION_HEVC // HEIC
+	HeifCompressionAv1  HeifCompression = C.VIPS_FOREIGN_HEIF_COMPRESSION_AV1  // AVIF
+)
+
+// Heifload reads a HEIF or AVIF file into an Image.  Requires VIPS 8.8 or
+// later built with libheif.
+func Heifload(filename string) (*Image, error) {
+	var out *C.struct__VipsImage
+	cf := C.CString(filename)
+	e := C.cgo_vips_heifload(cf, &out)
+	C.free(unsafe.Pointer(cf))
+	return loadError(out, e)
+}
+
+// HeifloadBuffer reads a HEIF or AVIF byte slice into an Image.  Requires
+// VIPS 8.8 or later built with libheif.
+func HeifloadBuffer(buf []byte) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_heifload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out)
+	return loadError(out, e)
+}
+
+// HeifsaveBuffer writes an Image to a HEIF byte slice.
+// Q specifies the compression factor between 1 and 100.
+// Lossless encodes the image without any loss, at a large file size.
+// Compression selects the codec, where HeifCompressionAv1 writes AVIF.
+// Speed trades compression for CPU time, from 0 (slowest) to 9 (fastest),
+// and is ignored before VIPS 8.10.  Requires VIPS 8.9 or later built with
+// libheif.
+func (in *Image) HeifsaveBuffer(q int, lossless bool, compression HeifCompression, speed int) ([]byte, error) {
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+
+	e := C.cgo_vips_heifsave_buffer(in.vi, &ptr, &length, C.int(q), C.int(btoi(lossless)), C.int(compression), C.int(speed))
+
+	return saveError(ptr, length, e)
+}
+
 // Jpegload reads and returns a JPEG file as an Image.
 func Jpegload(filename string) (*Image, error) {
 	var out *C.struct__VipsImage
@@ -141,9 +205,19 @@ func WebploadBufferShrink(buf []byte, shrink int) (*Image, error) {
 	return loadError(out, e)
 }
 
+// WebploadBufferPages reads n frames of a WebP byte slice into a single
+// Image, with frames stacked vertically.  Pass -1 to read all frames.  VIPS
+// versions before 8.8 only ever read the first frame.
+func WebploadBufferPages(buf []byte, n int) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_webpload_buffer_pages(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(n))
+	return loadError(out, e)
+}
+
 // WebpsaveBuffer writes an Image to a WebP byte slice.
 // Q specifies the compression factor for RGB channels between 0 and 100.
 // Lossless encodes the image without any loss, at a large file size.
+// If MetaPageHeight is set, the image is saved as an animation.
 func (in *Image) WebpsaveBuffer(q int, lossless bool) ([]byte, error) {
 	var ptr unsafe.Pointer
 	length := C.size_t(0)
@@ -2,6 +2,11 @@
 #include <vips/vips.h>
 #include <vips/vips7compat.h>
 
+#if (VIPS_MAJOR_VERSION < 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION < 9))
+#define VIPS_FOREIGN_HEIF_COMPRESSION_HEVC 1
+#define VIPS_FOREIGN_HEIF_COMPRESSION_AV1 4
+#endif
+
 int
 cgo_vips_gifload(const char *filename, VipsImage **out) {
     return vips_gifload(filename, out, NULL);
@@ -12,6 +17,57 @@ cgo_vips_gifload_buffer(void *buf, size_t len, VipsImage **out) {
     return vips_gifload_buffer(buf, len, out, NULL);
 }
 
+int
+cgo_vips_gifload_buffer_pages(void *buf, size_t len, VipsImage **out, int n) {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 5
+    return vips_gifload_buffer(buf, len, out, "n", n, NULL);
+#else
+    return vips_gifload_buffer(buf, len, out, NULL);
+#endif
+}
+
+int
+cgo_vips_gifsave_buffer(VipsImage *in, void **buf, size_t *len) {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 12
+    return vips_gifsave_buffer(in, buf, len, NULL);
+#else
+    vips_error("gifsave_buffer", "GIF saving requires VIPS 8.12 or later");
+    return -1;
+#endif
+}
+
+int
+cgo_vips_heifload(const char *filename, VipsImage **out) {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 8
+    return vips_heifload(filename, out, NULL);
+#else
+    vips_error("heifload", "HEIF loading requires VIPS 8.8 or later");
+    return -1;
+#endif
+}
+
+int
+cgo_vips_heifload_buffer(void *buf, size_t len, VipsImage **out) {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 8
+    return vips_heifload_buffer(buf, len, out, NULL);
+#else
+    vips_error("heifload_buffer", "HEIF loading requires VIPS 8.8 or later");
+    return -1;
+#endif
+}
+
+int
+cgo_vips_heifsave_buffer(VipsImage *in, void **buf, size_t *len, int q, int lossless, int compression, int speed) {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 10
+    return vips_heifsave_buffer(in, buf, len, "Q", q, "lossless", lossless, "compression", compression, "speed", speed, NULL);
+#elif VIPS_MINOR_VERSION >= 9
+    return vips_heifsave_buffer(in, buf, len, "Q", q, "lossless", lossless, "compression", compression, NULL);
+#else
+    vips_error("heifsave_buffer", "HEIF saving requires VIPS 8.9 or later");
+    return -1;
+#endif
+}
+
 int
 cgo_vips_jpegload(const char *filename, VipsImage **out, int shrink) {
     return vips_jpegload(filename, out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, NULL);
@@ -52,6 +108,15 @@ cgo_vips_webpload_buffer(void *buf, size_t len, VipsImage **out, int shrink) {
     return vips_webpload_buffer(buf, len, out, "shrink", shrink, NULL);
 }
 
+int
+cgo_vips_webpload_buffer_pages(void *buf, size_t len, VipsImage **out, int n) {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 8
+    return vips_webpload_buffer(buf, len, out, "n", n, NULL);
+#else
+    return vips_webpload_buffer(buf, len, out, NULL);
+#endif
+}
+
 int
 cgo_vips_webpsave_buffer(VipsImage *in, void **buf, size_t *len, int q, int lossless) {
     return vips_webpsave_buffer(in, buf, len, "Q", q, "lossless", lossless, NULL);
@@ -10,10 +10,12 @@ import (
 	"unsafe"
 )
 
-// Potential values for ImageGetAsString.
+// Potential values for ImageGetAsString and ImageGetInt.
 const (
 	ExifOrientation = "exif-ifd0-Orientation"
 	MetaIccName     = "icc-profile-data"
+	MetaNPages      = "n-pages"
+	MetaPageHeight  = "page-height"
 )
 
 // BandFormat is the format used for each band element.  Each corresponds to
@@ -58,6 +60,24 @@ func (in *Image) ImageGetAsString(field string) (string, bool) {
 	return s, e == 0
 }
 
+// ImageGetInt returns the contents of Image's integer metadata field along
+// with a bool which will be true on success.
+func (in *Image) ImageGetInt(field string) (int, bool) {
+	var out C.int
+	cf := C.CString(field)
+	e := C.cgo_vips_image_get_int(in.vi, cf, &out)
+	C.free(unsafe.Pointer(cf))
+
+	return int(out), e == 0
+}
+
+// ImageSetInt sets Image's metadata field to an integer value.
+func (in *Image) ImageSetInt(field string, value int) {
+	cf := C.CString(field)
+	C.vips_image_set_int(in.vi, cf, C.int(value))
+	C.free(unsafe.Pointer(cf))
+}
+
 // ImageGetBands returns the number of bands (channels) in the image.
 func (in *Image) ImageGetBands() int {
 	return int(C.vips_image_get_bands(in.vi))
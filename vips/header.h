@@ -9,3 +9,11 @@ cgo_vips_image_get_as_string(const VipsImage *image, const char *field, const ch
     }
     return -1;
 }
+
+int
+cgo_vips_image_get_int(const VipsImage *image, const char *field, int *out) {
+    if (vips_image_get_typeof(image, field) != 0 && !vips_image_get_int((VipsImage *)image, field, out)) {
+        return 0;
+    }
+    return -1;
+}
@@ -19,6 +19,19 @@ var (
 	// (*Image).Resize() scaling calculations, in pixels.  Set to 0 as
 	// of VIPS 8.4, and 0.5 for earlier versons.
 	ResizeOffset = 0.0
+
+	// AnimatedGifSave is true if GifsaveBuffer can save animations, as
+	// of VIPS 8.12.
+	AnimatedGifSave = false
+	// AnimatedWebpSave is true if WebpsaveBuffer can save animations,
+	// as of VIPS 8.8.
+	AnimatedWebpSave = false
+	// SmartcropSupported is true if Smartcrop is available, as of VIPS
+	// 8.5.
+	SmartcropSupported = false
+	// AvifSupported is true if VIPS was built to load and save AVIF, as
+	// of VIPS 8.9.
+	AvifSupported = false
 )
 
 // Initialize starts up the world of VIPS. You should call this on program
@@ -42,6 +55,11 @@ func Initialize() {
 	if C.VIPS_MAJOR_VERSION == 8 && C.VIPS_MINOR_VERSION < 4 {
 		ResizeOffset = 0.5
 	}
+
+	AnimatedGifSave = C.VIPS_MAJOR_VERSION > 8 || C.VIPS_MINOR_VERSION >= 12
+	AnimatedWebpSave = C.VIPS_MAJOR_VERSION > 8 || C.VIPS_MINOR_VERSION >= 8
+	SmartcropSupported = C.VIPS_MAJOR_VERSION > 8 || C.VIPS_MINOR_VERSION >= 5
+	AvifSupported = C.cgo_vips_heif_supported() != 0
 }
 
 // LeakSet turns leak checking on or off.  You should call this very early
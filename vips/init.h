@@ -6,3 +6,13 @@ int
 cgo_vips_init() {
     return VIPS_INIT("fotomat");
 }
+
+int
+cgo_vips_heif_supported() {
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 9
+    return vips_type_find("VipsOperation", "heifsave_buffer") != 0 &&
+        vips_type_find("VipsOperation", "heifload_buffer") != 0;
+#else
+    return 0;
+#endif
+}
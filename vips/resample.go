@@ -57,6 +57,14 @@ func (in *Image) Resize(xscale, yscale float64) error {
 	return in.imageError(out, e)
 }
 
+// Upsample enlarges in to exactly width by height pixels using the
+// supplied interpolate.  Nohalo gives the best results when enlarging.
+func (in *Image) Upsample(width, height int, interpolate *Interpolate) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_upsample(in.vi, &out, C.int(width), C.int(height), interpolate.interpolate)
+	return in.imageError(out, e)
+}
+
 // Shrink in by a pair of factors with a simple box filter.  You will get
 // aliasing for non-integer shrinks.  In this case, shrink with this
 // function to the nearest integer size above the target shrink, then
@@ -8,6 +8,27 @@ cgo_vips_affine(VipsImage *in, VipsImage **out, double a, double b, double c, do
     return vips_affine(in, out, a, b, c, d, "interpolate", interpolate, NULL);
 }
 
+int
+cgo_vips_upsample(VipsImage *in, VipsImage **out, int width, int height, VipsInterpolate *interpolate) {
+    double xscale = (double)width / in->Xsize;
+    double yscale = (double)height / in->Ysize;
+    VipsArrayInt *oarea = vips_array_int_newv(4, 0, 0, width, height);
+
+    // Line up pixel centres rather than corners, so the image isn't shifted.
+#if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 5
+    int e = vips_affine(in, out, xscale, 0.0, 0.0, yscale,
+        "interpolate", interpolate, "oarea", oarea, "extend", VIPS_EXTEND_COPY,
+        "idx", 0.5, "idy", 0.5, "odx", -0.5, "ody", -0.5, NULL);
+#else
+    int e = vips_affine(in, out, xscale, 0.0, 0.0, yscale,
+        "interpolate", interpolate, "oarea", oarea,
+        "idx", 0.5, "idy", 0.5, "odx", -0.5, "ody", -0.5, NULL);
+#endif
+    vips_area_unref(VIPS_AREA(oarea));
+
+    return e;
+}
+
 int
 cgo_vips_resize(VipsImage *in, VipsImage **out, double xscale, double yscale) {
 #if VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 4